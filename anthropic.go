@@ -0,0 +1,209 @@
+package main
+
+// Endpoints with "provider": "anthropic" speak the Anthropic Messages API,
+// which differs from OpenAI's chat completions: the system prompt is a
+// top-level field, max_tokens is required, the response is a list of content
+// blocks and streamed responses are a sequence of typed server-sent events.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// anthropicVersion is the Messages API version ficta was written against.
+const anthropicVersion = "2023-06-01"
+
+// anthropicOptions are the AI: line options of Anthropic endpoints.
+var anthropicOptions = map[string]optionSpec{
+	"stream": {"stream", optionBool},
+	"top_p":  {"top_p", optionFloat},
+	"top_k":  {"top_k", optionInt},
+	"stop":   {"stop_sequences", optionList},
+}
+
+// anthropicRequest is the body of a /v1/messages request.
+type anthropicRequest struct {
+	Model       string                 `json:"model"`
+	System      string                 `json:"system,omitempty"`
+	Messages    []anthropicMessage     `json:"messages"`
+	MaxTokens   int                    `json:"max_tokens"`
+	Temperature float64                `json:"temperature"`
+	Stream      bool                   `json:"stream,omitempty"`
+	Extra       map[string]interface{} `json:"-"` // AI: line options but stream
+}
+
+func (r anthropicRequest) MarshalJSON() ([]byte, error) {
+	type plain anthropicRequest // without this method
+	return marshalWithExtra(plain(r), r.Extra)
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// anthropicUsage is the token usage reported with a response.
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicResponse is a complete /v1/messages response.
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+// anthropicEvent is one server-sent event of a streamed response. Only the
+// fields ficta uses are decoded.
+type anthropicEvent struct {
+	Type    string             `json:"type"`
+	Message *anthropicResponse `json:"message"` // message_start
+	Delta   struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"` // content_block_delta
+	Usage *anthropicUsage `json:"usage"` // message_delta
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"` // error
+}
+
+// anthropicCompleter sends requests to the Anthropic Messages API. There is
+// no n parameter, so n completions take n requests.
+type anthropicCompleter struct{}
+
+func (anthropicCompleter) Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error) {
+	var result completion
+	r, err := anthropicRequestFor(req, ep.temperature(req))
+	if err != nil {
+		return result, err
+	}
+	key, err := ep.apiKey()
+	if err != nil {
+		return result, err
+	}
+	headers := map[string]string{
+		"x-api-key":         key,
+		"anthropic-version": anthropicVersion,
+	}
+	url := strings.TrimSuffix(ep.URL, "/") + "/v1/messages"
+	for i := 0; i < req.N; i++ {
+		var (
+			text  string
+			usage anthropicUsage
+		)
+		err = withRetries(ctx, func(ctx context.Context) error {
+			var err error
+			text, usage, err = anthropicPost(ctx, url, headers, r)
+			return err
+		})
+		if err != nil {
+			return completion{}, err
+		}
+		result.Choices = append(result.Choices, text)
+		result.PromptTokens += usage.InputTokens
+		result.CompletionTokens += usage.OutputTokens
+	}
+	log.Printf("tokens: prompt=%d, completion=%d, total=%d\n", result.PromptTokens, result.CompletionTokens, result.PromptTokens+result.CompletionTokens)
+	return result, nil
+}
+
+// anthropicRequestFor builds the request body for req with the given
+// temperature. Options other than stream are added to the body.
+func anthropicRequestFor(req completionRequest, temperature float64) (anthropicRequest, error) {
+	r := anthropicRequest{
+		Model:       req.Model,
+		System:      req.System,
+		Messages:    []anthropicMessage{{Role: "user", Content: req.Prompt}},
+		MaxTokens:   req.MaxTokens,
+		Temperature: temperature,
+		Extra:       make(map[string]interface{}),
+	}
+	for k, v := range req.Options {
+		spec, err := lookupOption(providerAnthropic, anthropicOptions, k)
+		if err != nil {
+			return r, err
+		}
+		value, err := spec.value(v)
+		if k == "stream" {
+			r.Stream = err == nil && value.(bool)
+		} else {
+			r.Extra[spec.field] = value
+		}
+		if err != nil {
+			return r, fmt.Errorf("option %s=%s: %w", k, v, err)
+		}
+	}
+	return r, nil
+}
+
+// anthropicPost sends r and returns the text of the response and its token
+// usage. A streamed response is assembled from its events.
+func anthropicPost(ctx context.Context, url string, headers map[string]string, r anthropicRequest) (string, anthropicUsage, error) {
+	var usage anthropicUsage
+	resp, err := postJSON(ctx, url, headers, r)
+	if err != nil {
+		return "", usage, err
+	}
+	defer resp.Body.Close()
+	var text strings.Builder
+	if !r.Stream {
+		var ar anthropicResponse
+		if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+			return "", usage, err
+		}
+		for _, block := range ar.Content {
+			if block.Type == "text" {
+				text.WriteString(block.Text)
+			}
+		}
+		return text.String(), ar.Usage, nil
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue // event: lines repeat the type given in the data
+		}
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return "", usage, err
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				usage.InputTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" {
+				text.WriteString(event.Delta.Text)
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				usage.OutputTokens = event.Usage.OutputTokens
+			}
+		case "message_stop":
+			return text.String(), usage, nil
+		case "error":
+			if event.Error != nil {
+				return "", usage, fmt.Errorf("anthropic: %s: %s", event.Error.Type, event.Error.Message)
+			}
+			return "", usage, errors.New("anthropic: error event")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", usage, err
+	}
+	return "", usage, errors.New("anthropic: response ended early")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// anthropicStandIn is an httptest server that answers like the Anthropic
+// Messages API and records the request bodies it receives. The model
+// "overloaded" fails with a 529, and "broken" fails in the middle of a
+// stream.
+func anthropicStandIn(t *testing.T, bodies *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "test-key" || r.Header.Get("anthropic-version") != anthropicVersion {
+			t.Errorf("Unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		*bodies = append(*bodies, body)
+		if body["model"] == "overloaded" {
+			w.WriteHeader(529)
+			fmt.Fprint(w, `{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`)
+			return
+		}
+		if body["stream"] != true {
+			fmt.Fprint(w, `{"content": [{"type": "text", "text": "The tide came in."}], "usage": {"input_tokens": 9, "output_tokens": 5}}`)
+			return
+		}
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\": \"message_start\", \"message\": {\"usage\": {\"input_tokens\": 9, \"output_tokens\": 1}}}\n\n")
+		fmt.Fprint(w, "event: content_block_start\ndata: {\"type\": \"content_block_start\", \"index\": 0, \"content_block\": {\"type\": \"text\", \"text\": \"\"}}\n\n")
+		for _, word := range []string{"The tide", " came", " in."} {
+			fmt.Fprintf(w, "event: content_block_delta\ndata: {\"type\": \"content_block_delta\", \"index\": 0, \"delta\": {\"type\": \"text_delta\", \"text\": %q}}\n\n", word)
+		}
+		if body["model"] == "broken" {
+			fmt.Fprint(w, "event: error\ndata: {\"type\": \"error\", \"error\": {\"type\": \"api_error\", \"message\": \"Internal error\"}}\n\n")
+			return
+		}
+		fmt.Fprint(w, "event: content_block_stop\ndata: {\"type\": \"content_block_stop\", \"index\": 0}\n\n")
+		fmt.Fprint(w, "event: message_delta\ndata: {\"type\": \"message_delta\", \"delta\": {\"stop_reason\": \"end_turn\"}, \"usage\": {\"output_tokens\": 5}}\n\n")
+		fmt.Fprint(w, "event: message_stop\ndata: {\"type\": \"message_stop\"}\n\n")
+	}))
+}
+
+func TestAnthropicCompleter(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := anthropicStandIn(t, &bodies)
+	defer server.Close()
+	t.Setenv("FICTA_TEST_ANTHROPIC_KEY", "test-key")
+	ep := &endpoint{Name: "anthropic", URL: server.URL, Provider: providerAnthropic, Auth: authConfig{Type: authEnv, Env: "FICTA_TEST_ANTHROPIC_KEY"}}
+
+	for _, stream := range []string{"false", "true"} {
+		bodies = nil
+		req := completionRequest{
+			Model:       "claude-3-5-haiku-latest",
+			Prompt:      "The sea",
+			System:      "You are a novelist.",
+			MaxTokens:   200,
+			Temperature: 0.7,
+			N:           2,
+			Options:     map[string]string{"stream": stream, "top_k": "40", "stop": "CHAPTER|THE END"},
+		}
+		c, err := anthropicCompleter{}.Complete(context.Background(), ep, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Choices) != 2 || c.Choices[0] != "The tide came in." || c.PromptTokens != 18 || c.CompletionTokens != 10 {
+			t.Errorf("stream=%s: unexpected result %+v", stream, c)
+		}
+		body := bodies[0]
+		if body["system"] != "You are a novelist." || body["max_tokens"] != float64(200) || body["temperature"] != 0.7 || body["top_k"] != float64(40) {
+			t.Errorf("stream=%s: unexpected request %v", stream, body)
+		}
+		if stop, _ := body["stop_sequences"].([]interface{}); len(stop) != 2 || stop[0] != "CHAPTER" || stop[1] != "THE END" || body["stop"] != nil {
+			t.Errorf("stream=%s: expected two stop_sequences, got %v", stream, body)
+		}
+		if msgs, _ := body["messages"].([]interface{}); len(msgs) != 1 {
+			t.Errorf("stream=%s: expected one message, got %v", stream, body["messages"])
+		}
+	}
+}
+
+func TestAnthropicCompleterErrors(t *testing.T) {
+	defer func(r int, s func(time.Duration)) { maxRetries, sleep = r, s }(maxRetries, sleep)
+	maxRetries, sleep = 1, func(time.Duration) {}
+	var bodies []map[string]interface{}
+	server := anthropicStandIn(t, &bodies)
+	defer server.Close()
+	t.Setenv("FICTA_TEST_ANTHROPIC_KEY", "test-key")
+	ep := &endpoint{Name: "anthropic", URL: server.URL, Provider: providerAnthropic, Auth: authConfig{Type: authEnv, Env: "FICTA_TEST_ANTHROPIC_KEY"}}
+
+	_, err := anthropicCompleter{}.Complete(context.Background(), ep, completionRequest{Model: "overloaded", Prompt: "x", MaxTokens: 10, N: 1})
+	if err == nil || len(bodies) != 2 || !strings.Contains(err.Error(), "529") || !strings.Contains(err.Error(), "Overloaded") {
+		t.Errorf("Expected a retried 529, got %v after %d requests", err, len(bodies))
+	}
+
+	bodies = nil
+	_, err = anthropicCompleter{}.Complete(context.Background(), ep, completionRequest{Model: "broken", Prompt: "x", MaxTokens: 10, N: 1, Options: map[string]string{"stream": "true"}})
+	if err == nil || !strings.Contains(err.Error(), "Internal error") {
+		t.Errorf("Expected the error event, got %v", err)
+	}
+	_, err = anthropicCompleter{}.Complete(context.Background(), ep, completionRequest{Model: "m", N: 1, Options: map[string]string{"top_p": "high"}})
+	if err == nil || !strings.Contains(err.Error(), "top_p=high") {
+		t.Errorf("Expected an option error, got %v", err)
+	}
+	bodies = nil
+	_, err = anthropicCompleter{}.Complete(context.Background(), ep, completionRequest{Model: "m", N: 1, Options: map[string]string{"seed": "3"}})
+	if err == nil || !strings.Contains(err.Error(), "option seed: not an option of anthropic endpoints") || len(bodies) != 0 {
+		t.Errorf("Expected an unknown option error without a request, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+// Saving a document whose prompt hasn't changed, or flipping between two
+// versions of it, would otherwise pay for the same request again. Responses
+// to requests that are repeatable, because the temperature is 0 or a seed is
+// set, are kept on disk and identical requests are answered from there.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache modes, set with -cache and the cache option of the AI: line.
+const (
+	cacheAuto = "auto" // cache repeatable requests
+	cacheOn   = "on"   // cache every request
+	cacheOff  = "off"  // never use the cache
+)
+
+var (
+	cacheMode string // the -cache mode
+	cacheDir  string // where responses are kept, set with -cd
+)
+
+// cacheStatsName is the file in cacheDir that counts hits and misses.
+const cacheStatsName = "stats.json"
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	Time       time.Time  `json:"time"`
+	Endpoint   string     `json:"endpoint"`
+	Model      string     `json:"model"`
+	Completion completion `json:"completion"`
+}
+
+// cacheStats counts the cache's use over all runs of ficta.
+type cacheStats struct {
+	Hits        int `json:"hits"`
+	Misses      int `json:"misses"`
+	TokensSaved int `json:"tokens_saved"`
+}
+
+var cacheStatsMu sync.Mutex
+
+// defaultCacheDir returns the cache directory used when -cd isn't given.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ficta")
+}
+
+// cachedCompleter answers requests from the cache and adds the responses of
+// the Completer it wraps to it.
+type cachedCompleter struct {
+	Completer
+}
+
+func (c cachedCompleter) Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error) {
+	if !cacheable(ep, req) {
+		return c.Completer.Complete(ctx, ep, req)
+	}
+	key, err := cacheKey(ep, req)
+	if err != nil {
+		return c.Completer.Complete(ctx, ep, req)
+	}
+	path := filepath.Join(cacheDir, key[:2], key+".json")
+	if data, err := os.ReadFile(path); err == nil {
+		var entry cacheEntry
+		if err := json.Unmarshal(data, &entry); err == nil {
+			log.Printf("cache: answered %s:%s from the cache", ep.Name, req.Model)
+			updateCacheStats(func(s *cacheStats) {
+				s.Hits++
+				s.TokensSaved += entry.Completion.PromptTokens + entry.Completion.CompletionTokens
+			})
+			entry.Completion.Cached = true
+			return entry.Completion, nil
+		}
+	}
+	result, err := c.Completer.Complete(ctx, ep, req)
+	if err != nil {
+		return result, err
+	}
+	updateCacheStats(func(s *cacheStats) { s.Misses++ })
+	entry := cacheEntry{Time: time.Now(), Endpoint: ep.Name, Model: req.Model, Completion: result}
+	if err := writeCacheEntry(path, entry); err != nil {
+		log.Println("cache:", err)
+	}
+	return result, nil
+}
+
+// cacheable reports whether the response to req may be cached: the cache is
+// on, or it is in auto mode and the request is repeatable. A seed only makes
+// it repeatable if ep's provider sends it.
+func cacheable(ep *endpoint, req completionRequest) bool {
+	if cacheDir == "" {
+		return false
+	}
+	switch req.CacheMode {
+	case cacheOn:
+		return true
+	case cacheAuto:
+		_, seeded := req.Options["seed"]
+		_, sent := providerOptions[ep.Provider]["seed"]
+		return seeded && sent || ep.temperature(req) == 0
+	}
+	return false
+}
+
+// cacheKey returns the hash of everything that determines the response to
+// req: the endpoint, the model, the messages and the sampling parameters.
+func cacheKey(ep *endpoint, req completionRequest) (string, error) {
+	// The endpoint is identified by its URL and provider rather than its
+	// name, so endpoints that are aliases of one server share responses.
+	data, err := json.Marshal(struct {
+		URL         string            `json:"url"`
+		Provider    string            `json:"provider"`
+		Model       string            `json:"model"`
+		System      string            `json:"system"`
+		Prompt      string            `json:"prompt"`
+		MaxTokens   int               `json:"max_tokens"`
+		Temperature float64           `json:"temperature"`
+		N           int               `json:"n"`
+		Options     map[string]string `json:"options"` // encoded in key order
+		Schema      json.RawMessage   `json:"schema,omitempty"`
+	}{ep.URL, ep.Provider, req.Model, req.System, req.Prompt, req.MaxTokens, ep.temperature(req), req.N, req.Options, req.Schema})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readCacheOption sets req.CacheMode from -cache or the AI: line's cache
+// option, which it removes from req's options.
+func readCacheOption(req *completionRequest) error {
+	req.CacheMode = cacheMode
+	v, ok := req.Options["cache"]
+	if !ok {
+		return nil
+	}
+	switch v {
+	case cacheAuto, cacheOn, cacheOff:
+		req.CacheMode = v
+	default:
+		return fmt.Errorf("option cache=%s: must be %s, %s or %s", v, cacheAuto, cacheOn, cacheOff)
+	}
+	delete(req.Options, "cache")
+	return nil
+}
+
+// writeCacheEntry writes entry to path, by way of a temporary file so that
+// a concurrent reader never sees half of it.
+func writeCacheEntry(path string, entry cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readCacheStats returns the counts kept in the cache directory.
+func readCacheStats() (cacheStats, error) {
+	var s cacheStats
+	data, err := os.ReadFile(filepath.Join(cacheDir, cacheStatsName))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	return s, json.Unmarshal(data, &s)
+}
+
+// updateCacheStats applies update to the counts kept in the cache directory.
+func updateCacheStats(update func(*cacheStats)) {
+	cacheStatsMu.Lock()
+	defer cacheStatsMu.Unlock()
+	s, err := readCacheStats()
+	if err != nil {
+		log.Println("cache:", err)
+		return
+	}
+	update(&s)
+	data, _ := json.Marshal(s)
+	if err := os.MkdirAll(cacheDir, 0700); err == nil {
+		err = os.WriteFile(filepath.Join(cacheDir, cacheStatsName), data, 0600)
+	}
+	if err != nil {
+		log.Println("cache:", err)
+	}
+}
+
+// runCache implements the cache subcommand: "ficta cache stats" describes the
+// cache and "ficta cache clear" empties it.
+func runCache(args []string) error {
+	if cacheDir == "" {
+		return errors.New("cache: no cache directory, set one with -cd")
+	}
+	if len(args) != 1 {
+		return errors.New("usage: ficta cache stats|clear")
+	}
+	switch args[0] {
+	case "stats":
+		entries, size := 0, int64(0)
+		err := filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || d.Name() == cacheStatsName {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entries++
+			size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		s, err := readCacheStats()
+		if err != nil {
+			return err
+		}
+		rate := 0
+		if s.Hits+s.Misses > 0 {
+			rate = 100 * s.Hits / (s.Hits + s.Misses)
+		}
+		fmt.Printf("cache:        %s\n", cacheDir)
+		fmt.Printf("entries:      %d (%d KiB)\n", entries, (size+1023)/1024)
+		fmt.Printf("hits:         %d (%d%%)\n", s.Hits, rate)
+		fmt.Printf("misses:       %d\n", s.Misses)
+		fmt.Printf("tokens saved: %d\n", s.TokensSaved)
+		return nil
+	case "clear":
+		// Remove only what ficta put there, in case -cd names a directory
+		// that holds other files too.
+		dirs, err := filepath.Glob(filepath.Join(cacheDir, "[0-9a-f][0-9a-f]"))
+		if err != nil {
+			return err
+		}
+		for _, dir := range append(dirs, filepath.Join(cacheDir, cacheStatsName)) {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+		fmt.Println("cache cleared:", cacheDir)
+		return nil
+	}
+	return fmt.Errorf("cache: unknown command %q, use stats or clear", args[0])
+}
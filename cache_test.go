@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheable(t *testing.T) {
+	defer func(dir string) { cacheDir = dir }(cacheDir)
+	cacheDir = t.TempDir()
+	tests := []struct {
+		name     string
+		provider string
+		req      completionRequest
+		expected bool
+	}{
+		{name: "Auto, warm", req: completionRequest{CacheMode: cacheAuto, Temperature: 0.7}, expected: false},
+		{name: "Auto, cold", req: completionRequest{CacheMode: cacheAuto, Temperature: 0}, expected: true},
+		{name: "Auto, seeded", req: completionRequest{CacheMode: cacheAuto, Temperature: 0.7, Options: map[string]string{"seed": "7"}}, expected: true},
+		{name: "Auto, seeded, no seed sent", provider: providerAnthropic, req: completionRequest{CacheMode: cacheAuto, Temperature: 0.7, Options: map[string]string{"seed": "7"}}, expected: false},
+		{name: "Auto, seeded, Ollama", provider: providerOllama, req: completionRequest{CacheMode: cacheAuto, Temperature: 0.7, Options: map[string]string{"seed": "7"}}, expected: true},
+		{name: "On", req: completionRequest{CacheMode: cacheOn, Temperature: 0.7}, expected: true},
+		{name: "Off", req: completionRequest{CacheMode: cacheOff, Temperature: 0}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := &endpoint{Provider: providerOpenAI}
+			if tt.provider != "" {
+				ep.Provider = tt.provider
+			}
+			if got := cacheable(ep, tt.req); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCachedCompleter(t *testing.T) {
+	defer func(dir string) { cacheDir = dir }(cacheDir)
+	cacheDir = t.TempDir()
+	f := &fakeCompleter{reply: echoChoices}
+	c := cachedCompleter{f}
+	ep := &endpoint{Name: "openai", Provider: providerOpenAI}
+	req := completionRequest{Model: "gpt-4", Prompt: "Once", MaxTokens: 10, N: 1, CacheMode: cacheAuto}
+
+	for i, expectCached := range []bool{false, true} {
+		result, err := c.Complete(context.Background(), ep, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Cached != expectCached || len(result.Choices) != 1 || result.PromptTokens != 7 {
+			t.Errorf("Request %d: unexpected result %+v", i, result)
+		}
+	}
+	if f.count() != 1 {
+		t.Errorf("Expected the second request to be answered from the cache, got %d requests", f.count())
+	}
+	// Any change to the request is a miss.
+	req.MaxTokens = 11
+	if result, _ := c.Complete(context.Background(), ep, req); result.Cached || f.count() != 2 {
+		t.Errorf("Expected a miss for a different request")
+	}
+	s, err := readCacheStats()
+	if err != nil || s.Hits != 1 || s.Misses != 2 || s.TokensSaved != 12 {
+		t.Errorf("Unexpected stats %+v, %v", s, err)
+	}
+
+	other := filepath.Join(cacheDir, "notes.txt")
+	os.WriteFile(other, nil, 0644)
+	if err := runCache([]string{"stats"}); err != nil {
+		t.Error(err)
+	}
+	if err := runCache([]string{"clear"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 1 || entries[0].Name() != "notes.txt" {
+		t.Errorf("Expected clear to leave only other files, got %v", entries)
+	}
+	if err := runCache([]string{"flush"}); err == nil {
+		t.Errorf("Expected an error for an unknown cache command")
+	}
+}
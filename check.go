@@ -0,0 +1,164 @@
+package main
+
+// "ficta check" finds the mistakes in documents that would otherwise only
+// show up after a request, or not at all: a malformed AI: line silently
+// sends the request with the default model parameters. Nothing is sent, and
+// the exit status is non-zero if any document has a problem, so it can run
+// in CI.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// checkProblem is a problem found in a document.
+type checkProblem struct {
+	Line    int // counted from 1, 0 for the whole document
+	Message string
+}
+
+func (p checkProblem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// checkReport is what check found in a document.
+type checkReport struct {
+	File     string
+	Problems []checkProblem
+	// The request the document would make, if it has no problems.
+	Model            string // the first model of its fallback chain
+	PromptTokens     int    // estimated, including the system prompt
+	CompletionTokens int    // at most
+	Cost             float64
+	CostKnown        bool
+}
+
+// runCheck implements the check subcommand:
+//
+//	ficta check file|dir [file|dir ...]
+//
+// It reports the problems of each document and the size and cost of the
+// request it would make.
+func runCheck(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ficta check file|dir [file|dir ...]")
+	}
+	files, err := exportFiles(args)
+	if err != nil {
+		return err
+	}
+	// Preparing a prompt logs some of the problems check reports itself.
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	failed := 0
+	for _, filename := range files {
+		text, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Printf("%s: %v\n", filename, err)
+			failed++
+			continue
+		}
+		r := checkDocument(string(text), filename)
+		printCheck(r)
+		if len(r.Problems) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("check: %d of %d documents have problems", failed, len(files))
+	}
+	return nil
+}
+
+// checkDocument checks text, the contents of the document filename, the way
+// a request would prepare it, without running the pre-hook.
+func checkDocument(text, filename string) checkReport {
+	r := checkReport{File: filename}
+	front, body := splitFrontMatter(text)
+	_, aiLine := findLastAILine(body)
+	if aiLine == "" {
+		if fm, err := parseFrontMatter(front); err == nil && fm.Model == "" {
+			r.Problems = append(r.Problems, checkProblem{Message: "no AI: line; ficta will use its default model parameters"})
+		}
+	}
+	for _, d := range diagnoseAILines(text) {
+		r.Problems = append(r.Problems, checkProblem{Line: d.Range.Start.Line + 1, Message: d.Message})
+	}
+	// An unknown comment profile is reported by preparePrompt below.
+	if syn, err := commentSyntaxFor(filename, text); err == nil {
+		_, warnings := stripComments(text, syn)
+		for _, w := range warnings {
+			r.Problems = append(r.Problems, checkProblem{Line: w.Line, Message: w.Message})
+		}
+	}
+	sort.SliceStable(r.Problems, func(i, j int) bool { return r.Problems[i].Line < r.Problems[j].Line })
+	doc, _, err := preparePrompt(text, filename)
+	if err != nil {
+		r.Problems = append(r.Problems, checkProblem{Message: err.Error()})
+		return r
+	}
+	r.Problems = append(r.Problems, optionProblems(doc.model, doc.req.Options)...)
+	r.Model = modelChain(doc.model)[0]
+	r.PromptTokens = estimateTokens(doc.req.Prompt) + estimateTokens(doc.req.System)
+	r.CompletionTokens = doc.req.MaxTokens * doc.req.N
+	r.Cost, r.CostKnown = cost(r.Model, r.PromptTokens, r.CompletionTokens)
+	return r
+}
+
+// optionProblems returns the problems with opts, the options from the AI:
+// line, directives and front matter: files they name, already relative to
+// the document, that don't exist, and options a model of the fallback chain
+// model doesn't take.
+func optionProblems(model string, opts map[string]string) []checkProblem {
+	var problems []checkProblem
+	for _, k := range sortedKeys(opts) {
+		if contains(fileOptions, k) && opts[k] != "" {
+			if _, err := os.Stat(opts[k]); err != nil {
+				problems = append(problems, checkProblem{Message: fmt.Sprintf("option %s=%s: %v", k, opts[k], err)})
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, spec := range modelChain(model) {
+		ep, _ := resolveModel(spec)
+		options, ok := providerOptions[ep.Provider]
+		if !ok {
+			continue // reported when the request is made
+		}
+		for _, k := range sortedKeys(opts) {
+			o, err := lookupOption(ep.Provider, options, k)
+			if err == nil {
+				if _, err = o.value(opts[k]); err != nil {
+					err = fmt.Errorf("option %s=%s: %w", k, opts[k], err)
+				}
+			}
+			if err != nil && !seen[err.Error()] {
+				seen[err.Error()] = true
+				problems = append(problems, checkProblem{Message: fmt.Sprintf("%s: %v", spec, err)})
+			}
+		}
+	}
+	return problems
+}
+
+func printCheck(r checkReport) {
+	for _, p := range r.Problems {
+		fmt.Printf("%s: %s\n", r.File, p)
+	}
+	if r.Model == "" {
+		return
+	}
+	price := "cost unknown"
+	if r.CostKnown {
+		price = fmt.Sprintf("up to $%.4f", r.Cost)
+	}
+	fmt.Printf("%s: %s, about %d prompt tokens, up to %d completion tokens, %s\n",
+		r.File, r.Model, r.PromptTokens, r.CompletionTokens, price)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckDocument(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	writeTestConfig(t, `{}`)
+	tests := []struct {
+		name     string
+		text     string
+		problems []string
+	}{
+		{name: "Good", text: "Once upon a time.\n\nAI: gpt-4, 100, 0.500, 1"},
+		{name: "Front matter model", text: "---\nmodel: gpt-4\n---\nOnce upon a time.\n"},
+		{
+			name:     "Malformed AI: line",
+			text:     "Once upon a time.\n\nAI: gpt-4, lots, 0.500, 1",
+			problems: []string{"line 3: ", "ficta will use its default model parameters"},
+		},
+		{
+			name:     "No AI: line",
+			text:     "Once upon a time.\n",
+			problems: []string{"no AI: line; ficta will use its default model parameters"},
+		},
+		{
+			name:     "Unterminated block comment",
+			text:     "Once upon a time.\n/* a note\n\nAI: gpt-4, 100, 0.500, 1",
+			problems: []string{`line 2: block comment is not closed with "*/"`},
+		},
+		{
+			name:     "Unknown directive",
+			text:     "//! bogus: x\nOnce upon a time.\n\nAI: gpt-4, 100, 0.500, 1",
+			problems: []string{`line 1: unknown directive "bogus:"`},
+		},
+		{
+			name:     "Misspelled directive",
+			text:     "//! tmep=0.9\nOnce upon a time.\n\nAI: gpt-4, 100, 0.500, 1",
+			problems: []string{"line 1: directive tmep=0.9: not a directive or an option"},
+		},
+		{name: "Stop directive", text: "//! stop=CHAPTER\nOnce upon a time.\n\nAI: anthropic:claude-3-5-sonnet-latest, 100, 0.500, 1"},
+		{
+			name:     "Option the provider doesn't take",
+			text:     "//! seed=3\nOnce upon a time.\n\nAI: anthropic:claude-3-5-sonnet-latest, 100, 0.500, 1",
+			problems: []string{"anthropic:claude-3-5-sonnet-latest: option seed: not an option of anthropic endpoints"},
+		},
+		{
+			name:     "Unknown AI: line option",
+			text:     "Once upon a time.\n\nAI: gpt-4, 100, 0.500, 1, seeed=3",
+			problems: []string{"gpt-4: option seeed: not an option of openai endpoints"},
+		},
+		{
+			name:     "Bad option value",
+			text:     "Once upon a time.\n\nAI: ollama:llama3, 100, 0.500, 1, num_ctx=lots",
+			problems: []string{"ollama:llama3: option num_ctx=lots: "},
+		},
+		{
+			name:     "Missing schema",
+			text:     "@SCHEMA missing.json\nOnce upon a time.\n\nAI: gpt-4, 100, 0.500, 1",
+			problems: []string{"missing.json"},
+		},
+		{
+			name:     "Missing system prompt",
+			text:     "Once upon a time.\n\nAI: gpt-4, 100, 0.500, 1, system=missing.txt",
+			problems: []string{"option system=", "missing.txt"},
+		},
+		{
+			name:     "Missing grammar",
+			text:     "Once upon a time.\n\nAI: llamacpp, 100, 0.500, 1, grammar=missing.gbnf",
+			problems: []string{"option grammar=", "missing.gbnf"},
+		},
+		{
+			name:     "Undefined variable",
+			text:     "Once upon a time {{hero}} ran.\n\nAI: gpt-4, 100, 0.500, 1",
+			problems: []string{"undefined variable hero"},
+		},
+		{
+			name:     "Front matter out of range",
+			text:     "---\nmodel: gpt-4\ntemperature: 5\n---\nOnce upon a time.\n",
+			problems: []string{"front matter: temperature 5: must be between 0 and 1"},
+		},
+		{
+			name:     "Bad front matter",
+			text:     "---\nmodle: gpt-4\n---\nOnce upon a time.\n\nAI: gpt-4, 100, 0.500, 1",
+			problems: []string{"front matter:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := checkDocument(tt.text, filepath.Join(t.TempDir(), "story.ait"))
+			if len(tt.problems) == 0 {
+				if len(r.Problems) != 0 {
+					t.Errorf("Expected no problems, got %v", r.Problems)
+				}
+				return
+			}
+			if len(r.Problems) != 1 {
+				t.Fatalf("Expected one problem, got %v", r.Problems)
+			}
+			for _, s := range tt.problems {
+				if !strings.Contains(r.Problems[0].String(), s) {
+					t.Errorf("Expected a problem containing %q, got %q", s, r.Problems[0])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckDocumentEstimate(t *testing.T) {
+	writeTestConfig(t, `{}`)
+	text := "---\nsystem: Be brief.\n---\nOnce upon a time there was a weasel.\n\nAI: gpt-4o | gpt-4o-mini, 500, 0.700, 2"
+	got := checkDocument(text, "")
+	expected := checkReport{Model: "gpt-4o", PromptTokens: 13, CompletionTokens: 1000, Cost: 0.0100325, CostKnown: true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+	if got := checkDocument("Once.\n\nAI: mystery, 100, 0.700, 1", ""); !reflect.DeepEqual(got, checkReport{Model: "mystery", PromptTokens: 2, CompletionTokens: 100}) {
+		t.Errorf("Expected an unknown cost, got %+v", got)
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	dir := t.TempDir()
+	write := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ch1.ait", "Once upon a time.\n\nAI: gpt-4, 100, 0.500, 1")
+	if err := runCheck([]string{dir}); err != nil {
+		t.Errorf("Expected no problems, got %v", err)
+	}
+	write("ch2.ait", "Once upon a time.\n\nAI: gpt-4, lots, 0.500, 1")
+	if err := runCheck([]string{dir}); err == nil || err.Error() != "check: 1 of 2 documents have problems" {
+		t.Errorf("Expected a problem, got %v", err)
+	}
+	if err := runCheck(nil); err == nil || !strings.HasPrefix(err.Error(), "usage:") {
+		t.Errorf("Expected a usage error, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+// Author comments are notes in a document that are never sent to the model.
+// The tokenizer here finds them anywhere in a line: a line comment runs from
+// its prefix, at the start of a line or after white space, to the end of the
+// line, and a block comment from its prefix to its suffix, on the same line
+// or a later one. A backslash before a delimiter makes it ordinary text.
+//
+// The delimiters depend on the kind of document: Markdown can't use "//",
+// which is ordinary text there, so documents pick a comment profile by their
+// extension or by a modeline.
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	nestedComments  bool // set by -nb: block comments may contain block comments
+	commentFlagsSet bool // -c, -y or -z was given, overriding extensions
+)
+
+// commentSyntax holds a document's comment delimiters. An empty delimiter
+// is never matched.
+type commentSyntax struct {
+	Line        string // starts a comment that ends with the line
+	LineStart   bool   // line comments start only at the beginning of a line
+	BlockPrefix string // starts a block comment
+	BlockSuffix string // ends a block comment
+	Nested      bool   // block comments may contain block comments
+}
+
+// commentProfiles are the comment syntaxes documents can choose by name.
+var commentProfiles = map[string]commentSyntax{
+	"c":     {Line: "//", BlockPrefix: "/*", BlockSuffix: "*/"},
+	"html":  {BlockPrefix: "<!--", BlockSuffix: "-->"},
+	"latex": {Line: "%"},
+	"org":   {Line: "#", LineStart: true, BlockPrefix: "#+BEGIN_COMMENT", BlockSuffix: "#+END_COMMENT"},
+}
+
+// commentExtensions maps file extensions to the comment profile documents
+// with them use. Others use the syntax of -c, -y and -z.
+var commentExtensions = map[string]string{
+	".md":       "html",
+	".markdown": "html",
+	".html":     "html",
+	".htm":      "html",
+	".tex":      "latex",
+	".org":      "org",
+}
+
+// modelinePattern matches a modeline, e.g. "<!-- ficta: comments=html -->",
+// which must be the first line of a document.
+var modelinePattern = regexp.MustCompile(`\bficta:\s*comments=(\S*)`)
+
+// authorCommentSyntax returns the comment syntax set by -c, -y, -z and -nb.
+func authorCommentSyntax() commentSyntax {
+	return commentSyntax{Line: lineCommentPrefix, BlockPrefix: blockCommentPrefix, BlockSuffix: blockCommentSuffix, Nested: nestedComments}
+}
+
+// commentSyntaxFor returns the comment syntax of the document filename,
+// whose contents are text: the profile named by its modeline or its front
+// matter, or the syntax set by -c, -y and -z if any of them were given, or
+// the profile for its extension. -nb applies to all of them.
+func commentSyntaxFor(filename, text string) (commentSyntax, error) {
+	if name, ok := frontMatterComments(text); ok {
+		syn := commentProfiles[name]
+		syn.Nested = syn.Nested || nestedComments
+		return syn, nil
+	}
+	if name, ok := modeline(text); ok {
+		syn, ok := commentProfiles[name]
+		if !ok {
+			return authorCommentSyntax(), fmt.Errorf("modeline: unknown comment profile %q, use %s", name, strings.Join(sortedKeys(commentProfiles), ", "))
+		}
+		syn.Nested = syn.Nested || nestedComments
+		return syn, nil
+	}
+	if name, ok := commentExtensions[strings.ToLower(filepath.Ext(filename))]; ok && !commentFlagsSet {
+		syn := commentProfiles[name]
+		syn.Nested = syn.Nested || nestedComments
+		return syn, nil
+	}
+	return authorCommentSyntax(), nil
+}
+
+// modeline returns the comment profile named by text's modeline, if it has
+// one.
+func modeline(text string) (string, bool) {
+	first, _, _ := strings.Cut(text, "\n")
+	m := modelinePattern.FindStringSubmatch(first)
+	if m == nil {
+		return "", false
+	}
+	return strings.TrimSuffix(m[1], "-->"), true
+}
+
+// removeModeline removes text's modeline, which is never part of a prompt
+// whatever the comment syntax it is written in.
+func removeModeline(text string) string {
+	if _, ok := modeline(text); !ok {
+		return text
+	}
+	_, rest, _ := strings.Cut(text, "\n")
+	return rest
+}
+
+// comment returns s as a comment: a line comment if the syntax has them,
+// otherwise a block comment.
+func (syn commentSyntax) comment(s string) string {
+	if syn.Line != "" {
+		return syn.Line + " " + s
+	}
+	return syn.BlockPrefix + " " + s + " " + syn.BlockSuffix
+}
+
+// commentWarning describes a problem with the comments of a document, which
+// is otherwise processed as well as it can be.
+type commentWarning struct {
+	Line    int // counted from 1
+	Message string
+}
+
+func (w commentWarning) String() string {
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
+}
+
+// processAuthorComments removes the author comments from a text string.
+// The arguments lcprefix, bcprefix, and bcsuffix are comment delimiters
+// for line and block comments. Problems are ignored; see stripComments.
+func processAuthorComments(text, lcprefix, bcprefix, bcsuffix string) string {
+	stripped, _ := stripComments(text, commentSyntax{Line: lcprefix, BlockPrefix: bcprefix, BlockSuffix: bcsuffix, Nested: nestedComments})
+	return stripped
+}
+
+// stripAuthorComments removes the author comments described by syn from
+// text, the contents of the document filename, and logs any problems with
+// them.
+func stripAuthorComments(text, filename string, syn commentSyntax) string {
+	stripped, warnings := stripComments(text, syn)
+	for _, w := range warnings {
+		log.Printf("%s: %s", filename, w)
+	}
+	return stripped
+}
+
+// stripComments removes the comments described by syn from text and reports
+// an unterminated block comment and block comment suffixes found outside a
+// block comment, which are kept as text.
+//
+// Lines that held nothing but comments are removed. Otherwise white space
+// left at the end of a line is trimmed, and that after a block comment is
+// dropped if the comment followed white space, so "a /* b */ c" becomes
+// "a c".
+func stripComments(text string, syn commentSyntax) (string, []commentWarning) {
+	var (
+		kept     []string
+		warnings []commentWarning
+		depth    int // of block comments
+		opened   int // the line where the outermost block comment began
+	)
+	for n, line := range strings.Split(text, "\n") {
+		var b strings.Builder
+		commented := depth > 0
+		for i := 0; i < len(line); {
+			rest := line[i:]
+			if d := escapedDelimiter(rest, syn); d != "" {
+				if depth == 0 {
+					b.WriteString(d)
+				}
+				i += 1 + len(d)
+				continue
+			}
+			switch {
+			case depth > 0 && hasDelimiter(rest, syn.BlockSuffix):
+				depth--
+				i += len(syn.BlockSuffix)
+				if depth == 0 && (b.Len() == 0 || isBlank(b.String()[b.Len()-1])) {
+					for i < len(line) && isBlank(line[i]) {
+						i++
+					}
+				}
+			case depth > 0 && syn.Nested && hasDelimiter(rest, syn.BlockPrefix):
+				depth++
+				i += len(syn.BlockPrefix)
+			case depth > 0:
+				i++
+			case hasDelimiter(rest, syn.BlockPrefix):
+				depth, opened, commented = 1, n+1, true
+				i += len(syn.BlockPrefix)
+			case hasDelimiter(rest, syn.Line) && syn.lineCommentAt(line, i):
+				commented = true
+				i = len(line)
+			case hasDelimiter(rest, syn.BlockSuffix):
+				warnings = append(warnings, commentWarning{n + 1, fmt.Sprintf("%q outside a block comment is kept as text", syn.BlockSuffix)})
+				b.WriteString(syn.BlockSuffix)
+				i += len(syn.BlockSuffix)
+			default:
+				b.WriteByte(line[i])
+				i++
+			}
+		}
+		s := b.String()
+		if commented {
+			s = strings.TrimRight(s, " \t")
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+		}
+		kept = append(kept, s)
+	}
+	if depth > 0 {
+		warnings = append(warnings, commentWarning{opened, fmt.Sprintf("block comment is not closed with %q; it runs to the end of the document", syn.BlockSuffix)})
+	}
+	return strings.Join(kept, "\n"), warnings
+}
+
+// escapedDelimiter returns the delimiter of syn that follows a backslash at
+// the start of s, the longest if several do, or "".
+func escapedDelimiter(s string, syn commentSyntax) string {
+	if !strings.HasPrefix(s, `\`) {
+		return ""
+	}
+	found := ""
+	for _, d := range []string{syn.Line, syn.BlockPrefix, syn.BlockSuffix} {
+		if hasDelimiter(s[1:], d) && len(d) > len(found) {
+			found = d
+		}
+	}
+	return found
+}
+
+// lineCommentAt reports whether a line comment prefix at line[i] starts a
+// comment: at the start of the line, after white space unless LineStart is
+// set.
+func (syn commentSyntax) lineCommentAt(line string, i int) bool {
+	if syn.LineStart {
+		return strings.TrimLeft(line[:i], " \t") == ""
+	}
+	return i == 0 || isBlank(line[i-1])
+}
+
+func hasDelimiter(s, delimiter string) bool {
+	return delimiter != "" && strings.HasPrefix(s, delimiter)
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
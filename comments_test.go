@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStripComments(t *testing.T) {
+	cStyle := commentSyntax{Line: "//", BlockPrefix: "/*", BlockSuffix: "*/"}
+	nested := commentSyntax{Line: "//", BlockPrefix: "/*", BlockSuffix: "*/", Nested: true}
+	html := commentSyntax{BlockPrefix: "<!--", BlockSuffix: "-->"}
+	latex := commentSyntax{Line: "%"}
+	tests := []struct {
+		name     string
+		syntax   commentSyntax
+		text     string
+		expected string
+		warnings []commentWarning
+	}{
+		{name: "No comments", syntax: cStyle, text: "Once upon a time\nthere was a fox.", expected: "Once upon a time\nthere was a fox."},
+		{name: "Empty text", syntax: cStyle, text: "", expected: ""},
+		{name: "Blank lines are kept", syntax: cStyle, text: "One\n\n\nTwo", expected: "One\n\n\nTwo"},
+		{name: "Line comment", syntax: cStyle, text: "// a note\nText", expected: "Text"},
+		{name: "Indented line comment", syntax: cStyle, text: "\t  // a note\nText", expected: "Text"},
+		{name: "Trailing line comment", syntax: cStyle, text: "Text // a note\nMore", expected: "Text\nMore"},
+		{name: "URL is not a comment", syntax: cStyle, text: "See http://example.com for more.", expected: "See http://example.com for more."},
+		{name: "Prefix inside a word", syntax: cStyle, text: "and//or", expected: "and//or"},
+		{name: "Inline block comment", syntax: cStyle, text: "text /* note */ more text", expected: "text more text"},
+		{name: "Inline block comment without spaces", syntax: cStyle, text: "text/*note*/more", expected: "textmore"},
+		{name: "Block comment at line start", syntax: cStyle, text: "/* note */ text", expected: "text"},
+		{name: "Indented block comment keeps indentation", syntax: cStyle, text: "  /* note */ text", expected: "  text"},
+		{name: "Block comment at line end", syntax: cStyle, text: "text /* note */", expected: "text"},
+		{name: "Same-line block comment", syntax: cStyle, text: "/* note */\nText", expected: "Text"},
+		{name: "Same-line block does not toggle", syntax: cStyle, text: "/*Not a comment*/\nStill text\nMore text", expected: "Still text\nMore text"},
+		{name: "Two block comments on a line", syntax: cStyle, text: "a /* b */ c /* d */ e", expected: "a c e"},
+		{name: "Multi-line block comment", syntax: cStyle, text: "Before\n/* one\ntwo\nthree */\nAfter", expected: "Before\nAfter"},
+		{name: "Block comment starting mid-line", syntax: cStyle, text: "Before /* one\ntwo */ after", expected: "Before\nafter"},
+		{name: "Text after block suffix is kept", syntax: cStyle, text: "/* one\ntwo */ Text", expected: "Text"},
+		{name: "Line comment inside block comment", syntax: cStyle, text: "/* a // b */ c", expected: "c"},
+		{name: "Block prefix inside line comment", syntax: cStyle, text: "// a /* b\nc", expected: "c"},
+		{name: "Block prefix inside block comment", syntax: cStyle, text: "/* a /* b */ c */", expected: "c */",
+			warnings: []commentWarning{{1, `"*/" outside a block comment is kept as text`}}},
+		{name: "Nested block comments", syntax: nested, text: "/* a /* b */ c */ d", expected: "d"},
+		{name: "Nested multi-line block comments", syntax: nested, text: "x\n/* a\n/* b */\nc */\ny", expected: "x\ny"},
+		{name: "Stray block suffix", syntax: cStyle, text: "Text */\nMore", expected: "Text */\nMore",
+			warnings: []commentWarning{{1, `"*/" outside a block comment is kept as text`}}},
+		{name: "Unterminated block comment", syntax: cStyle, text: "One\n/* two\nthree", expected: "One",
+			warnings: []commentWarning{{2, `block comment is not closed with "*/"; it runs to the end of the document`}}},
+		{name: "Unterminated nested block comment", syntax: nested, text: "/* a /* b */\nc", expected: "",
+			warnings: []commentWarning{{1, `block comment is not closed with "*/"; it runs to the end of the document`}}},
+		{name: "Escaped line prefix", syntax: cStyle, text: `Use \// for comments.`, expected: "Use // for comments."},
+		{name: "Escaped block prefix", syntax: cStyle, text: `A \/* is not a comment`, expected: "A /* is not a comment"},
+		{name: "Escaped block suffix inside a comment", syntax: cStyle, text: `/* a \*/ b */ c`, expected: "c"},
+		{name: "Escaped block suffix outside a comment", syntax: cStyle, text: `a \*/ b`, expected: "a */ b"},
+		{name: "Other backslashes are kept", syntax: cStyle, text: `C:\temp \n`, expected: `C:\temp \n`},
+		{name: "HTML comments", syntax: html, text: "Text <!-- note --> more\n<!--\nhidden\n-->\nEnd // kept", expected: "Text more\nEnd // kept"},
+		{name: "LaTeX comments", syntax: latex, text: "% preamble\n50% off % a note", expected: "50% off"},
+		{name: "No delimiters", syntax: commentSyntax{}, text: "// /* */", expected: "// /* */"},
+		{name: "Org comments", syntax: commentProfiles["org"], text: "# a note\nIssue #5 is fixed.\n#+BEGIN_COMMENT\nhidden\n#+END_COMMENT\nEnd", expected: "Issue #5 is fixed.\nEnd"},
+		{name: "Windows line endings", syntax: cStyle, text: "// note\r\nText\r\n", expected: "Text\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings := stripComments(tt.text, tt.syntax)
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("Expected warnings %v, got %v", tt.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestDiagnoseComments(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	diags := diagnoseComments("Once upon a time\n/* a note\n\nAI: gpt-4, 100, 0.7, 1", "story.txt")
+	if len(diags) != 1 || diags[0].Range.Start.Line != 1 || diags[0].Range.End.Character != 9 || diags[0].Severity != lspSeverityWarning {
+		t.Errorf("Expected a warning on line 1, got %v", diags)
+	}
+	// In Markdown "/*" is text.
+	if diags := diagnoseComments("Once upon a time\n/* a note", "story.md"); len(diags) != 0 {
+		t.Errorf("Expected no warnings for Markdown, got %v", diags)
+	}
+	diags = diagnoseComments("<!-- ficta: comments=rst -->\nOnce upon a time", "story.md")
+	if len(diags) != 1 || diags[0].Severity != lspSeverityError || diags[0].Range.End.Character != 28 {
+		t.Errorf("Expected an error for the modeline, got %v", diags)
+	}
+}
+
+func TestCommentSyntaxFor(t *testing.T) {
+	defer func(lc, bp, bs string, set bool) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix, commentFlagsSet = lc, bp, bs, set
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix, commentFlagsSet)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = ";", "#|", "|#"
+	lisp := commentSyntax{Line: ";", BlockPrefix: "#|", BlockSuffix: "|#"}
+	tests := []struct {
+		filename      string
+		text          string
+		flagsSet      bool
+		expected      commentSyntax
+		expectedError string
+	}{
+		{filename: "story.ait", text: "Once", expected: lisp},
+		{filename: "", text: "Once", expected: lisp},
+		{filename: "story.md", text: "Once", expected: commentProfiles["html"]},
+		{filename: "STORY.MD", text: "Once", expected: commentProfiles["html"]},
+		{filename: "paper.tex", text: "Once", expected: commentProfiles["latex"]},
+		{filename: "notes.org", text: "Once", expected: commentProfiles["org"]},
+		{filename: "story.md", text: "Once", flagsSet: true, expected: lisp},
+		{filename: "story.ait", text: "// ficta: comments=html\nOnce", expected: commentProfiles["html"]},
+		{filename: "story.md", text: "<!-- ficta: comments=c -->\nOnce", flagsSet: true, expected: commentProfiles["c"]},
+		{filename: "story.md", text: "<!-- ficta: comments=latex-->\nOnce", expected: commentProfiles["latex"]},
+		{filename: "story.ait", text: "Once\n// ficta: comments=html", expected: lisp},
+		{filename: "story.ait", text: "// ficta: comments=rst\nOnce", expectedError: `unknown comment profile "rst"`},
+	}
+	for _, tt := range tests {
+		commentFlagsSet = tt.flagsSet
+		syn, err := commentSyntaxFor(tt.filename, tt.text)
+		if tt.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("%s %q: expected an error containing %q, got %v", tt.filename, tt.text, tt.expectedError, err)
+			}
+			continue
+		}
+		if err != nil || syn != tt.expected {
+			t.Errorf("%s %q: expected %+v, got %+v, %v", tt.filename, tt.text, tt.expected, syn, err)
+		}
+	}
+}
+
+func TestCompleteTextMarkdown(t *testing.T) {
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+	text := "<!-- ficta: comments=html -->\n# Chapter 1\n<!-- a note -->\nIt was night. // not a comment\n\nAI: gpt-4o | gpt-4o-mini, 100, 0.700, 2"
+	got, _, err := completeText(text, "story.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<!-- ficta: comments=html -->\n# Chapter 1\n<!-- a note -->\nIt was night. // not a comment\n\n" +
+		"<!-- response 1 of 2 -->\n\nIt was a dark night.\n\n<!-- response 2 of 2 -->\n\nIt was a dark night.\n\n" +
+		"<!-- produced by gpt-4o -->\n\nAI: gpt-4o | gpt-4o-mini, 100, 0.700, 2"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if prompt := f.requests[0].Prompt; prompt != "# Chapter 1\nIt was night. // not a comment\n\n" {
+		t.Errorf("Expected the modeline and comment to be removed from the prompt, got %q", prompt)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+// "ficta compare" sends a document's prompt to several models at once and
+// writes their responses side by side, with latency, token usage and cost,
+// into a comparison file next to the document, so that choosing a model for
+// a project doesn't mean editing the AI: line over and over.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compareExt is the extension of comparison files.
+const compareExt = "compare.md"
+
+// price is the cost of a model in US dollars per million prompt and
+// completion tokens.
+type price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// defaultPrices are the list prices of well known models. The config file's
+// "prices" add to and override them.
+var defaultPrices = map[string]price{
+	"gpt-3.5-turbo":            {0.50, 1.50},
+	"gpt-4":                    {30, 60},
+	"gpt-4-turbo":              {10, 30},
+	"gpt-4o":                   {2.50, 10},
+	"gpt-4o-mini":              {0.15, 0.60},
+	"claude-3-5-sonnet-latest": {3, 15},
+	"claude-3-5-haiku-latest":  {0.80, 4},
+	"gemini-1.5-pro":           {1.25, 5},
+	"gemini-1.5-flash":         {0.075, 0.30},
+}
+
+var (
+	pricesMu sync.Mutex
+	prices   map[string]price // by model name, set by loadConfig
+)
+
+// cost returns the cost in dollars of a request to the model spec and
+// whether it is known. Models on local servers cost nothing.
+func cost(spec string, promptTokens, completionTokens int) (float64, bool) {
+	ep, model := resolveModel(spec)
+	if ep.Provider == providerOllama || ep.Provider == providerLlamaCpp || ep.LlamaCpp {
+		return 0, true
+	}
+	pricesMu.Lock()
+	p, ok := prices[model]
+	pricesMu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	return (float64(promptTokens)*p.Prompt + float64(completionTokens)*p.Completion) / 1e6, true
+}
+
+// comparison is one model's part of a comparison.
+type comparison struct {
+	spec    string
+	result  completion
+	elapsed time.Duration
+	err     error
+}
+
+// runCompare implements the compare subcommand:
+//
+//	ficta compare file model [model ...]
+//
+// The document's prompt and AI: line settings are sent to all the models at
+// once and the results are written to the comparison file. The document
+// itself is left alone.
+func runCompare(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: ficta compare file model [model ...]")
+	}
+	filename, specs := args[0], args[1:]
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	doc, entry, err := prepareDocument(string(text), filename)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	results := compareModels(context.Background(), doc.req, specs)
+	for _, c := range results {
+		e := entry
+		e.Time, e.Elapsed, e.UsedModel = start, c.elapsed.Seconds(), c.spec
+		e.PromptTokens, e.CompletionTokens, e.Cached = c.result.PromptTokens, c.result.CompletionTokens, c.result.Cached
+		if c.err != nil {
+			e.Error = c.err.Error()
+		}
+		if err := appendJournal(filename, e); err != nil {
+			fmt.Fprintln(os.Stderr, "journal:", err)
+		}
+	}
+	out := replaceExtension(filename, compareExt)
+	if err := os.WriteFile(out, []byte(formatComparison(filename, doc.req, results)), 0644); err != nil {
+		return err
+	}
+	fmt.Println("comparison written to", out)
+	return nil
+}
+
+// compareModels sends req to each of the model specs concurrently and
+// returns the results in the order of specs.
+func compareModels(ctx context.Context, req completionRequest, specs []string) []comparison {
+	results := make([]comparison, len(specs))
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		results[i].spec = spec
+		wg.Add(1)
+		go func(c *comparison) {
+			defer wg.Done()
+			start := time.Now()
+			c.result, c.err = sendChat(ctx, c.spec, req)
+			c.elapsed = time.Since(start)
+			for i, s := range c.result.Choices {
+				if c.err == nil {
+					c.result.Choices[i], c.err = finishResponse(s, c.spec, req)
+				}
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// formatComparison returns the Markdown comparison of results for the
+// document filename: a summary table followed by each model's response.
+func formatComparison(filename string, req completionRequest, results []comparison) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Comparison for %s\n\n", filename)
+	fmt.Fprintf(&b, "%s, max tokens %d, temperature %0.3f, N %d\n\n", time.Now().Format("2006-01-02 15:04"), req.MaxTokens, req.Temperature, req.N)
+	b.WriteString("| model | time | prompt tokens | completion tokens | cost |\n")
+	b.WriteString("|---|---|---|---|---|\n")
+	for _, c := range results {
+		if c.err != nil {
+			fmt.Fprintf(&b, "| %s | %0.1fs | | | failed |\n", c.spec, c.elapsed.Seconds())
+			continue
+		}
+		dollars := "?"
+		if v, ok := cost(c.spec, c.result.PromptTokens, c.result.CompletionTokens); ok {
+			dollars = fmt.Sprintf("$%0.4f", v)
+		}
+		if c.result.Cached {
+			dollars += " (cached)"
+		}
+		fmt.Fprintf(&b, "| %s | %0.1fs | %d | %d | %s |\n", c.spec, c.elapsed.Seconds(), c.result.PromptTokens, c.result.CompletionTokens, dollars)
+	}
+	for _, c := range results {
+		fmt.Fprintf(&b, "\n## %s\n\n", c.spec)
+		if c.err != nil {
+			fmt.Fprintf(&b, "Failed: %v\n", c.err)
+			continue
+		}
+		for i, s := range c.result.Choices {
+			if len(c.result.Choices) > 1 {
+				fmt.Fprintf(&b, "### Response %d of %d\n\n", i+1, len(c.result.Choices))
+			}
+			b.WriteString(strings.TrimSpace(s) + "\n\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCompare(t *testing.T) {
+	if err := loadConfig("", false); err != nil {
+		t.Fatal(err)
+	}
+	defer func(name string) { journalName = name }(journalName)
+	journalName = ".journal.jsonl"
+	f := &fakeCompleter{reply: func(req completionRequest) (completion, error) {
+		if req.Model == "missing" {
+			return completion{}, errors.New("model not found")
+		}
+		return completion{Choices: []string{"Said by " + req.Model + "."}, PromptTokens: 1000, CompletionTokens: 500}, nil
+	}}
+	useFakeCompleter(t, f)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "story.txt")
+	os.WriteFile(filename, []byte("// a note\nOnce upon a time\n\nAI: gpt-4, 100, 0.500, 1"), 0644)
+	if err := runCompare([]string{filename, "gpt-4o", "gpt-4o-mini", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.count() != 3 {
+		t.Errorf("Expected 3 requests, got %d", f.count())
+	}
+	for _, req := range f.requests {
+		if req.Prompt != f.requests[0].Prompt || strings.Contains(req.Prompt, "a note") {
+			t.Errorf("Expected the same cleaned prompt for every model, got %q", req.Prompt)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "story.compare.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, s := range []string{
+		"| gpt-4o | ", "| 1000 | 500 | $0.0075 |",
+		"| gpt-4o-mini | ", "| 1000 | 500 | $0.0004 |",
+		"| missing | ", "| failed |",
+		"## gpt-4o-mini\n\nSaid by gpt-4o-mini.",
+		"## missing\n\nFailed: model not found",
+	} {
+		if !strings.Contains(text, s) {
+			t.Errorf("Expected %q in the comparison:\n%s", s, text)
+		}
+	}
+	if before, _ := os.ReadFile(filename); !strings.HasSuffix(string(before), "AI: gpt-4, 100, 0.500, 1") {
+		t.Errorf("Expected the document to be left alone, got %q", before)
+	}
+	journal, _ := os.ReadFile(filepath.Join(dir, journalName))
+	if n := strings.Count(string(journal), "\n"); n != 3 {
+		t.Errorf("Expected 3 journal entries, got %d", n)
+	}
+	if err := runCompare([]string{filename}); err == nil {
+		t.Errorf("Expected a usage error without models")
+	}
+}
+
+func TestCost(t *testing.T) {
+	if err := loadConfig("", false); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := cost("gpt-4o", 1e6, 1e6); !ok || c != 12.5 {
+		t.Errorf("Expected $12.50, got %v, %v", c, ok)
+	}
+	if c, ok := cost("ollama:llama3", 1e6, 1e6); !ok || c != 0 {
+		t.Errorf("Expected local models to be free, got %v, %v", c, ok)
+	}
+	if _, ok := cost("my-model", 1, 1); ok {
+		t.Errorf("Expected an unknown price")
+	}
+	writeTestConfig(t, `{"prices": {"my-model": {"prompt": 1, "completion": 2}}}`)
+	if c, ok := cost("my-model", 1e6, 1e6); !ok || c != 3 {
+		t.Errorf("Expected a configured price of $3, got %v, %v", c, ok)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+// Each kind of server ficta talks to has a Completer. The rest of ficta deals
+// only in completionRequests and completions, so documents can be processed,
+// and tested, without knowing which server answers.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// completionRequest is a request for completions of a prompt.
+type completionRequest struct {
+	Doc            string            // the document's path, empty if it has none
+	Model          string            // the model name, without the endpoint prefix
+	Prompt         string            // the document text with comments removed
+	System         string            // the system prompt, if any
+	MaxTokens      int               // the AI: line's max tokens
+	Temperature    float64           // the AI: line's temperature, 0 to 1
+	RawTemperature *float64          // the raw_temp option, sent as it is
+	CacheMode      string            // whether to use the response cache, see cacheable
+	N              int               // the number of completions wanted
+	Options        map[string]string // the AI: line's key=value options
+	Schema         json.RawMessage   // the JSON schema responses must match, if any
+}
+
+// completion is a Completer's answer to a completionRequest.
+type completion struct {
+	Choices          []string `json:"choices"` // the text of each completion
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	Cached           bool     `json:"-"` // answered from the response cache
+}
+
+// A Completer sends completion requests to one kind of server. Transient
+// failures are retried with withRetries and a failure the server reported is
+// returned as a *statusError so it can decide retries and fallbacks.
+// Streaming stays inside the Completers whose providers have a stream option:
+// Complete returns the whole responses either way, since the document is
+// written only once they are complete.
+type Completer interface {
+	Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error)
+}
+
+// completers holds the Completer for each endpoint provider. Tests replace
+// entries with fakes.
+var completers = map[string]Completer{
+	providerOpenAI:    openAICompleter{},
+	providerOllama:    ollamaCompleter{},
+	providerLlamaCpp:  llamaCppCompleter{},
+	providerAnthropic: anthropicCompleter{},
+	providerGemini:    geminiCompleter{},
+}
+
+// readSystemPrompt moves the system option, the name of a file holding a
+// system prompt, from req's options to req.System.
+func readSystemPrompt(req *completionRequest) error {
+	path, ok := req.Options["system"]
+	if !ok {
+		return nil
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("option system=%s: %w", path, err)
+	}
+	req.System = strings.TrimSpace(string(text))
+	delete(req.Options, "system")
+	return nil
+}
+
+// sendChat sends req to the endpoint and model named by spec, one entry of a
+// fallback chain.
+func sendChat(ctx context.Context, spec string, req completionRequest) (completion, error) {
+	ep, model := resolveModel(spec)
+	if ep.Name == "url" && ep.URL == "" {
+		return completion{}, fmt.Errorf("model %q needs a URL endpoint, start ficta with -u", spec)
+	}
+	c, ok := completers[ep.Provider]
+	if !ok {
+		return completion{}, fmt.Errorf("endpoint %q: unknown provider %q", ep.Name, ep.Provider)
+	}
+	req.Model = model
+	return cachedCompleter{c}.Complete(ctx, ep, req)
+}
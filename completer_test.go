@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fakeCompleter answers requests from memory and records them.
+type fakeCompleter struct {
+	mu       sync.Mutex
+	requests []completionRequest
+	reply    func(req completionRequest) (completion, error)
+}
+
+func (f *fakeCompleter) Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	return f.reply(req)
+}
+
+func (f *fakeCompleter) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// useFakeCompleter makes f the Completer of OpenAI compatible endpoints, and
+// sets the default comment delimiters, for the rest of the test.
+func useFakeCompleter(t *testing.T, f *fakeCompleter) {
+	saved := completers[providerOpenAI]
+	lc, bp, bs := lineCommentPrefix, blockCommentPrefix, blockCommentSuffix
+	t.Cleanup(func() {
+		completers[providerOpenAI] = saved
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	})
+	completers[providerOpenAI] = f
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+}
+
+// echoChoices replies with n copies of "It was a dark night.".
+func echoChoices(req completionRequest) (completion, error) {
+	c := completion{PromptTokens: 7, CompletionTokens: 5}
+	for i := 0; i < req.N; i++ {
+		c.Choices = append(c.Choices, "It was a dark night.")
+	}
+	return c, nil
+}
+
+func TestCompleteText(t *testing.T) {
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+
+	text := "// a note\nOnce upon a time\n\nAI: gpt-4, 100, 0.500, 2, seed=3"
+	response, entry, err := completeText(text, "/tmp/story.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := f.requests[0]
+	if req.Model != "gpt-4" || req.Doc != "/tmp/story.txt" || req.MaxTokens != 100 || req.Temperature != 0.5 || req.N != 2 || req.Options["seed"] != "3" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if strings.Contains(req.Prompt, "a note") {
+		t.Errorf("Expected comments to be removed from the prompt %q", req.Prompt)
+	}
+	expected := "// a note\nOnce upon a time\n\n// response 1 of 2\n\nIt was a dark night.\n\n// response 2 of 2\n\nIt was a dark night.\n\nAI: gpt-4, 100, 0.500, 2, seed=3"
+	if response != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, response)
+	}
+	if entry.UsedModel != "gpt-4" || entry.PromptTokens != 7 || entry.CompletionTokens != 5 || *entry.RawTemperature != 1 {
+		t.Errorf("Unexpected journal entry %+v", entry)
+	}
+
+	// raw_temp reaches the Completer and the journal, and stays in the trailer.
+	response, entry, err = completeText("Once\n\nAI: gpt-4, 100, 0.500, 1, raw_temp=0.3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = f.requests[1]
+	if req.RawTemperature == nil || *req.RawTemperature != 0.3 || req.Options["raw_temp"] != "" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if *entry.RawTemperature != 0.3 || entry.Temperature != 0.5 || !strings.HasSuffix(response, "raw_temp=0.3") {
+		t.Errorf("Unexpected result %q, %+v", response, entry)
+	}
+}
+
+func TestCompleteTextFallback(t *testing.T) {
+	f := &fakeCompleter{reply: func(req completionRequest) (completion, error) {
+		if req.Model == "gpt-4" {
+			return completion{}, &statusError{StatusCode: 503}
+		}
+		return echoChoices(req)
+	}}
+	useFakeCompleter(t, f)
+	defer func(fs string) { fallbackStatus = fs }(fallbackStatus)
+	fallbackStatus = "503"
+
+	response, entry, err := completeText("Once\n\nAI: gpt-4 | gpt-4o-mini, 100, 0.500, 1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.count() != 2 || entry.UsedModel != "gpt-4o-mini" || !strings.Contains(response, "// produced by gpt-4o-mini") {
+		t.Errorf("Expected a fallback to gpt-4o-mini, got %q, %+v", response, entry)
+	}
+
+	f.reply = func(req completionRequest) (completion, error) { return completion{}, errors.New("bad request") }
+	if _, _, err := completeText("Once\n\nAI: gpt-4, 100, 0.500, 1", ""); err == nil {
+		t.Errorf("Expected the completer's error")
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	defer func(name string) { journalName = name }(journalName)
+	journalName = ""
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+
+	filename := filepath.Join(t.TempDir(), "story.txt")
+	if err := os.WriteFile(filename, []byte("Once upon a time\n\nAI: gpt-4, 100, 0.700, 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		watchFiles(watcher, []string{filename})
+		close(done)
+	}()
+	if err := watcher.Add(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// The author saves a change.
+	if err := os.WriteFile(filename, []byte("Once upon a time there was\n\nAI: gpt-4, 100, 0.700, 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Once upon a time there was\n\nIt was a dark night.\n\nAI: gpt-4, 100, 0.700, 1"
+	var text []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		text, _ = os.ReadFile(filename)
+		if string(text) == expected {
+			break
+		}
+	}
+	if string(text) != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, text)
+	}
+	watcher.Close()
+	<-done
+	if f.count() != 1 {
+		t.Errorf("Expected 1 request, got %d", f.count())
+	}
+}
+
+func TestReadSystemPrompt(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "novelist.txt"), []byte("You are a novelist.\n"), 0644)
+	req := completionRequest{Options: resolveOptionPaths(map[string]string{"system": "novelist.txt", "seed": "1"}, dir)}
+	if err := readSystemPrompt(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.System != "You are a novelist." || len(req.Options) != 1 {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	req = completionRequest{Options: map[string]string{"system": filepath.Join(dir, "missing.txt")}}
+	if err := readSystemPrompt(&req); err == nil || !strings.Contains(err.Error(), "system=") {
+		t.Errorf("Expected an error for a missing file, got %v", err)
+	}
+}
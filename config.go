@@ -0,0 +1,281 @@
+package main
+
+// Endpoints are the servers ficta sends requests to. Four are built in:
+// "openai", the OpenAI API, "url", the server given with -u, and "ollama" and
+// "llamacpp", local Ollama and llama.cpp servers. More can be declared in a JSON configuration file,
+// each with its own URL, API and way of getting credentials:
+//
+//	{
+//	  "endpoints": {
+//	    "local": {"url": "http://localhost:8080/v1/chat/completions", "llama_cpp": true},
+//	    "work":  {"url": "https://api.openai.com/v1/chat/completions",
+//	              "auth": {"type": "command", "command": "pass show openai/work"}}
+//	  }
+//	}
+//
+// A model spec "name:model" in the AI: line sends model to endpoint name; a
+// model without a known endpoint prefix goes to "openai". Credentials are
+// only looked up when an endpoint is first used, so a missing OpenAI key
+// doesn't matter to someone who only talks to a local server.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configPath is the configuration file given with -f.
+var configPath string
+
+// Ways an endpoint can get its API key.
+const (
+	authNone    = "none"    // no credentials
+	authEnv     = "env"     // the value of an environment variable
+	authFile    = "file"    // the contents of a file
+	authCommand = "command" // the output of a command, e.g. a password manager
+)
+
+// authConfig says where an endpoint's API key comes from.
+type authConfig struct {
+	Type    string `json:"type"`
+	Env     string `json:"env,omitempty"`
+	File    string `json:"file,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+// endpoint is a completion server and the credentials it needs.
+type endpoint struct {
+	Name         string     `json:"-"`
+	URL          string     `json:"url"` // "" means the goopenai default, the OpenAI API
+	Organization string     `json:"organization,omitempty"`
+	Auth         authConfig `json:"auth"`
+	Provider     string     `json:"provider,omitempty"`  // the API the server speaks, default providerOpenAI
+	LlamaCpp     bool       `json:"llama_cpp,omitempty"` // send llama.cpp's prompt caching parameters
+
+	// TemperatureRange overrides the provider's temperature range.
+	TemperatureRange *[2]float64 `json:"temperature_range,omitempty"`
+
+	mu  sync.Mutex
+	key string // the API key, once it has been looked up successfully
+}
+
+// The APIs ficta can speak.
+const (
+	providerOpenAI    = "openai"    // OpenAI chat completions, also mimicked by many servers
+	providerOllama    = "ollama"    // Ollama's native /api/chat and /api/generate
+	providerLlamaCpp  = "llamacpp"  // llama.cpp's raw /completion
+	providerAnthropic = "anthropic" // the Anthropic Messages API
+	providerGemini    = "gemini"    // Google's Gemini generateContent
+)
+
+// config is the layout of the configuration file.
+type config struct {
+	Endpoints    map[string]*endpoint `json:"endpoints"`
+	Prices       map[string]price     `json:"prices"`        // by model name
+	Author       string               `json:"author"`        // for new documents
+	DefaultModel string               `json:"default_model"` // for new documents
+}
+
+var (
+	endpointsMu sync.Mutex
+	endpoints   map[string]*endpoint // built-in and configured endpoints by name
+)
+
+// defaultConfigPath returns the configuration file used when -f isn't given.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ficta", "config.json")
+}
+
+// builtinEndpoints returns the endpoints that exist without configuration.
+func builtinEndpoints() map[string]*endpoint {
+	return map[string]*endpoint{
+		"openai": {
+			Name:         "openai",
+			Organization: os.Getenv("OPENAI_API_ORG"),
+			Auth:         authConfig{Type: authEnv, Env: "OPENAI_API_KEY"},
+			Provider:     providerOpenAI,
+		},
+		"url": {
+			Name:     "url",
+			URL:      urlEndpoint,
+			Auth:     authConfig{Type: authNone},
+			Provider: providerOpenAI,
+			LlamaCpp: true,
+		},
+		"ollama": {
+			Name:     "ollama",
+			URL:      "http://localhost:11434",
+			Auth:     authConfig{Type: authNone},
+			Provider: providerOllama,
+		},
+		"llamacpp": {
+			Name:     "llamacpp",
+			URL:      "http://localhost:8080",
+			Auth:     authConfig{Type: authNone},
+			Provider: providerLlamaCpp,
+		},
+		"anthropic": {
+			Name:     "anthropic",
+			URL:      "https://api.anthropic.com",
+			Auth:     authConfig{Type: authEnv, Env: "ANTHROPIC_API_KEY"},
+			Provider: providerAnthropic,
+		},
+		"gemini": {
+			Name:     "gemini",
+			URL:      "https://generativelanguage.googleapis.com",
+			Auth:     authConfig{Type: authEnv, Env: "GEMINI_API_KEY"},
+			Provider: providerGemini,
+		},
+	}
+}
+
+// loadConfig reads the configuration file at path. A missing file is only an
+// error if required is true. Configured endpoints replace built-in ones of
+// the same name.
+func loadConfig(path string, required bool) error {
+	eps := builtinEndpoints()
+	pr := make(map[string]price)
+	for model, p := range defaultPrices {
+		pr[model] = p
+	}
+	var cfg config
+	defer func() {
+		endpointsMu.Lock()
+		endpoints = eps
+		endpointsMu.Unlock()
+		pricesMu.Lock()
+		prices = pr
+		pricesMu.Unlock()
+		templateAuthor, templateModel = cfg.Author, cfg.DefaultModel
+	}()
+	templateDir = ""
+	if path == "" {
+		return nil
+	}
+	templateDir = filepath.Join(filepath.Dir(path), "templates")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, ep := range cfg.Endpoints {
+		if ep == nil || strings.ContainsAny(name, ":|, ") {
+			return fmt.Errorf("%s: invalid endpoint %q", path, name)
+		}
+		if ep.Provider == "" {
+			ep.Provider = providerOpenAI
+		}
+		if _, ok := completers[ep.Provider]; !ok {
+			return fmt.Errorf("%s: endpoint %q: unknown provider %q", path, name, ep.Provider)
+		}
+		if r := ep.TemperatureRange; r != nil && (r[0] < 0 || r[1] <= r[0]) {
+			return fmt.Errorf("%s: endpoint %q: invalid temperature range %v", path, name, *r)
+		}
+		switch ep.Auth.Type {
+		case "":
+			ep.Auth.Type = authNone
+		case authNone, authEnv, authFile, authCommand:
+		default:
+			return fmt.Errorf("%s: endpoint %q: unknown auth type %q", path, name, ep.Auth.Type)
+		}
+		ep.Name = name
+		eps[name] = ep
+	}
+	for model, p := range cfg.Prices {
+		pr[model] = p
+	}
+	return nil
+}
+
+// lookupEndpoint returns the endpoint with the given name.
+func lookupEndpoint(name string) (*endpoint, bool) {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	if endpoints == nil {
+		endpoints = builtinEndpoints()
+	}
+	ep, ok := endpoints[name]
+	return ep, ok
+}
+
+// resolveModel splits a model spec into its endpoint and the model name to
+// send. A bare endpoint name, like "url" or "llamacpp", selects that endpoint
+// and is sent as the model name too, which servers that host a single model
+// ignore.
+func resolveModel(spec string) (*endpoint, string) {
+	if name, model, ok := strings.Cut(spec, ":"); ok {
+		if ep, ok := lookupEndpoint(name); ok {
+			return ep, model
+		}
+	}
+	if ep, ok := lookupEndpoint(spec); ok {
+		return ep, spec
+	}
+	ep, _ := lookupEndpoint("openai")
+	return ep, spec
+}
+
+// apiKey returns the endpoint's API key, looking it up the first time it is
+// needed. Failures aren't cached, so an author can fix the problem, e.g.
+// unlock a password manager, and simply save again.
+func (ep *endpoint) apiKey() (string, error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.key != "" {
+		return ep.key, nil
+	}
+	var (
+		key string
+		err error
+	)
+	switch ep.Auth.Type {
+	case authNone, "":
+		return "", nil
+	case authEnv:
+		key = os.Getenv(ep.Auth.Env)
+		if key == "" {
+			err = fmt.Errorf("environment variable %s is not set", ep.Auth.Env)
+		}
+	case authFile:
+		var data []byte
+		data, err = os.ReadFile(expandHome(ep.Auth.File))
+		key = strings.TrimSpace(string(data))
+		if err == nil && key == "" {
+			err = fmt.Errorf("%s is empty", ep.Auth.File)
+		}
+	case authCommand:
+		key, err = runHook(ep.Auth.Command, "", 30*time.Second)
+		key = strings.TrimSpace(key)
+	default:
+		err = fmt.Errorf("unknown auth type %q", ep.Auth.Type)
+	}
+	if err != nil {
+		return "", fmt.Errorf("endpoint %s: no API key: %w", ep.Name, err)
+	}
+	ep.key = key
+	return key, nil
+}
+
+// expandHome replaces a leading "~/" in path with the user's home directory.
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes a configuration file and loads it.
+func writeTestConfig(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadConfig("", false) })
+}
+
+func TestResolveModel(t *testing.T) {
+	writeTestConfig(t, `{"endpoints": {"local": {"url": "http://localhost:8080/v1/chat/completions"}}}`)
+	tests := []struct {
+		spec             string
+		expectedEndpoint string
+		expectedModel    string
+	}{
+		{spec: "gpt-4o", expectedEndpoint: "openai", expectedModel: "gpt-4o"},
+		{spec: "url", expectedEndpoint: "url", expectedModel: "url"},
+		{spec: "url:llama3", expectedEndpoint: "url", expectedModel: "llama3"},
+		{spec: "local:llama3", expectedEndpoint: "local", expectedModel: "llama3"},
+		{spec: "openai:gpt-4", expectedEndpoint: "openai", expectedModel: "gpt-4"},
+		{spec: "ft:gpt-3.5-turbo:acme::abc123", expectedEndpoint: "openai", expectedModel: "ft:gpt-3.5-turbo:acme::abc123"},
+	}
+	for _, tt := range tests {
+		ep, model := resolveModel(tt.spec)
+		if ep.Name != tt.expectedEndpoint || model != tt.expectedModel {
+			t.Errorf("resolveModel(%q) = %s, %q", tt.spec, ep.Name, model)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	defer loadConfig("", false)
+	dir := t.TempDir()
+	if err := loadConfig(filepath.Join(dir, "missing.json"), false); err != nil {
+		t.Errorf("Expected a missing optional config to be ignored, got %v", err)
+	}
+	if err := loadConfig(filepath.Join(dir, "missing.json"), true); err == nil {
+		t.Errorf("Expected an error for a missing required config")
+	}
+	path := filepath.Join(dir, "bad.json")
+	os.WriteFile(path, []byte(`{"endpoints": {"x": {"auth": {"type": "magic"}}}}`), 0644)
+	if err := loadConfig(path, true); err == nil || !strings.Contains(err.Error(), "magic") {
+		t.Errorf("Expected an unknown auth type error, got %v", err)
+	}
+	os.WriteFile(path, []byte(`{"endpoints": {"x": {"temperature_range": [1, 0.5]}}}`), 0644)
+	if err := loadConfig(path, true); err == nil || !strings.Contains(err.Error(), "temperature range") {
+		t.Errorf("Expected an invalid temperature range error, got %v", err)
+	}
+}
+
+func TestEndpointAPIKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte("file-key\n"), 0600)
+	t.Setenv("FICTA_TEST_KEY", "env-key")
+	tests := []struct {
+		name        string
+		auth        authConfig
+		expected    string
+		expectedErr string
+	}{
+		{name: "None", auth: authConfig{Type: authNone}, expected: ""},
+		{name: "Env", auth: authConfig{Type: authEnv, Env: "FICTA_TEST_KEY"}, expected: "env-key"},
+		{name: "Env unset", auth: authConfig{Type: authEnv, Env: "FICTA_TEST_UNSET"}, expectedErr: "FICTA_TEST_UNSET is not set"},
+		{name: "File", auth: authConfig{Type: authFile, File: keyFile}, expected: "file-key"},
+		{name: "Missing file", auth: authConfig{Type: authFile, File: keyFile + ".nope"}, expectedErr: "no API key"},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct {
+			name        string
+			auth        authConfig
+			expected    string
+			expectedErr string
+		}{name: "Command", auth: authConfig{Type: authCommand, Command: "echo cmd-key"}, expected: "cmd-key"})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := &endpoint{Name: "test", Auth: tt.auth}
+			key, err := ep.apiKey()
+			if tt.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil || key != tt.expected {
+				t.Errorf("Expected %q, got %q, %v", tt.expected, key, err)
+			}
+		})
+	}
+}
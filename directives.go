@@ -0,0 +1,137 @@
+package main
+
+// A directive is an author comment that starts with "!", e.g.
+//
+//	//! temp=0.9
+//	//! stop=CHAPTER
+//	//! instruct: write in present tense
+//
+// It changes the next request only: ficta applies it and removes it from the
+// document along with writing the response. key=value directives override a
+// field of the AI: line, model, max_tokens, temp or n, or set an option as if
+// it were on the AI: line. instruct: adds an instruction to the system prompt.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// directiveMark follows the comment delimiter to make a directive.
+const directiveMark = "!"
+
+// directive is a directive line of a document.
+type directive struct {
+	Line  int // counted from 1
+	Key   string
+	Value string
+}
+
+func (d directive) String() string {
+	if d.Key == "instruct" {
+		return d.Key + ": " + d.Value
+	}
+	return d.Key + "=" + d.Value
+}
+
+// parseDirective returns the directive on line, which must be a whole line
+// comment in the syntax syn, or a whole block comment if it has no line
+// comments. ok is false if the line is not a directive.
+func parseDirective(line string, syn commentSyntax) (d directive, ok bool, err error) {
+	trimmed := strings.TrimSpace(line)
+	var body string
+	switch {
+	case syn.Line != "":
+		body, ok = strings.CutPrefix(trimmed, syn.Line+directiveMark)
+	case syn.BlockPrefix != "" && strings.HasSuffix(trimmed, syn.BlockSuffix):
+		body, ok = strings.CutPrefix(strings.TrimSuffix(trimmed, syn.BlockSuffix), syn.BlockPrefix+directiveMark)
+	}
+	if !ok {
+		return d, false, nil
+	}
+	// The first of '=' and ':' separates the key from the value, so that
+	// "instruct: use x=1" and "stop=Note:" both work.
+	i := strings.IndexAny(body, "=:")
+	if i < 0 {
+		return d, true, fmt.Errorf("unknown directive %q, expected key=value or instruct: text", strings.TrimSpace(body))
+	}
+	d.Key, d.Value = strings.TrimSpace(body[:i]), strings.TrimSpace(body[i+1:])
+	switch {
+	case d.Key == "":
+		return d, true, fmt.Errorf("directive %q has no key", strings.TrimSpace(body))
+	case body[i] == ':' && d.Key != "instruct":
+		return d, true, fmt.Errorf("unknown directive %q, expected key=value or instruct: text", d.Key+":")
+	}
+	return d, true, nil
+}
+
+// extractDirectives removes the directive lines from text, written in the
+// comment syntax syn, and returns what remains and the directives.
+func extractDirectives(text string, syn commentSyntax) (string, []directive, error) {
+	lines := strings.SplitAfter(text, "\n")
+	kept := lines[:0]
+	var directives []directive
+	for n, line := range lines {
+		d, ok, err := parseDirective(line, syn)
+		if err != nil {
+			return text, nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if !ok {
+			kept = append(kept, line)
+			continue
+		}
+		d.Line = n + 1
+		directives = append(directives, d)
+	}
+	return strings.Join(kept, ""), directives, nil
+}
+
+// requestSettings are the settings of a request that an AI: line gives and
+// directives may change.
+type requestSettings struct {
+	model        string
+	maxTokens    int
+	temperature  float64
+	n            int
+	opts         map[string]string
+	instructions []string
+}
+
+// apply changes s as d directs.
+func (s *requestSettings) apply(d directive) error {
+	var err error
+	switch d.Key {
+	case "model":
+		if d.Value == "" {
+			err = fmt.Errorf("empty model")
+		}
+		s.model = d.Value
+	case "max_tokens":
+		s.maxTokens, err = strconv.Atoi(d.Value)
+		if err == nil && s.maxTokens < 0 {
+			err = fmt.Errorf("must be 0 or more")
+		}
+	case "temp", "temperature":
+		s.temperature, err = strconv.ParseFloat(d.Value, 64)
+		if err == nil && (s.temperature < 0 || s.temperature > 1) {
+			err = fmt.Errorf("must be between 0 and 1")
+		}
+	case "n":
+		s.n, err = strconv.Atoi(d.Value)
+		if err == nil && s.n <= 0 {
+			err = fmt.Errorf("must be 1 or more")
+		}
+	case "instruct":
+		s.instructions = append(s.instructions, d.Value)
+	default:
+		if !knownOption(d.Key) {
+			err = fmt.Errorf("not a directive or an option")
+			break
+		}
+		s.opts[d.Key] = d.Value
+	}
+	if err != nil {
+		return fmt.Errorf("line %d: directive %s: %w", d.Line, d, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDirective(t *testing.T) {
+	cStyle := commentProfiles["c"]
+	html := commentProfiles["html"]
+	tests := []struct {
+		line          string
+		syntax        commentSyntax
+		expected      directive
+		expectedOK    bool
+		expectedError string
+	}{
+		{line: "//! temp=0.9", syntax: cStyle, expected: directive{Key: "temp", Value: "0.9"}, expectedOK: true},
+		{line: "  //!stop = CHAPTER", syntax: cStyle, expected: directive{Key: "stop", Value: "CHAPTER"}, expectedOK: true},
+		{line: "//! instruct: write in present tense", syntax: cStyle, expected: directive{Key: "instruct", Value: "write in present tense"}, expectedOK: true},
+		{line: "//! instruct: use x=1", syntax: cStyle, expected: directive{Key: "instruct", Value: "use x=1"}, expectedOK: true},
+		{line: "//! stop=Note:", syntax: cStyle, expected: directive{Key: "stop", Value: "Note:"}, expectedOK: true},
+		{line: "<!--! temp=0.2 -->", syntax: html, expected: directive{Key: "temp", Value: "0.2"}, expectedOK: true},
+		{line: "// temp=0.9", syntax: cStyle},
+		{line: "Wow! temp=0.9", syntax: cStyle},
+		{line: "text //! temp=0.9", syntax: cStyle},
+		{line: "<!--! temp=0.2", syntax: html},
+		{line: "//! be brief", syntax: cStyle, expectedOK: true, expectedError: `unknown directive "be brief"`},
+		{line: "//! note: later", syntax: cStyle, expectedOK: true, expectedError: `unknown directive "note:"`},
+		{line: "//! =0.9", syntax: cStyle, expectedOK: true, expectedError: "has no key"},
+	}
+	for _, tt := range tests {
+		d, ok, err := parseDirective(tt.line, tt.syntax)
+		if ok != tt.expectedOK {
+			t.Errorf("%q: expected ok=%v, got %v", tt.line, tt.expectedOK, ok)
+		}
+		if tt.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("%q: expected an error containing %q, got %v", tt.line, tt.expectedError, err)
+			}
+			continue
+		}
+		if err != nil || d != tt.expected {
+			t.Errorf("%q: expected %+v, got %+v, %v", tt.line, tt.expected, d, err)
+		}
+	}
+}
+
+func TestRequestSettingsApply(t *testing.T) {
+	tests := []struct {
+		directive     directive
+		expected      requestSettings
+		expectedError string
+	}{
+		{directive: directive{Key: "model", Value: "gpt-4o"}, expected: requestSettings{model: "gpt-4o", maxTokens: 100, temperature: 0.7, n: 1}},
+		{directive: directive{Key: "max_tokens", Value: "500"}, expected: requestSettings{model: "gpt-4", maxTokens: 500, temperature: 0.7, n: 1}},
+		{directive: directive{Key: "temp", Value: "0.9"}, expected: requestSettings{model: "gpt-4", maxTokens: 100, temperature: 0.9, n: 1}},
+		{directive: directive{Key: "temperature", Value: "0"}, expected: requestSettings{model: "gpt-4", maxTokens: 100, temperature: 0, n: 1}},
+		{directive: directive{Key: "n", Value: "3"}, expected: requestSettings{model: "gpt-4", maxTokens: 100, temperature: 0.7, n: 3}},
+		{directive: directive{Key: "instruct", Value: "be brief"}, expected: requestSettings{model: "gpt-4", maxTokens: 100, temperature: 0.7, n: 1, instructions: []string{"be brief"}}},
+		{directive: directive{Key: "stop", Value: "CHAPTER"}, expected: requestSettings{model: "gpt-4", maxTokens: 100, temperature: 0.7, n: 1, opts: map[string]string{"stop": "CHAPTER"}}},
+		{directive: directive{Line: 3, Key: "temp", Value: "1.5"}, expectedError: "line 3: directive temp=1.5: must be between 0 and 1"},
+		{directive: directive{Key: "n", Value: "0"}, expectedError: "must be 1 or more"},
+		{directive: directive{Key: "max_tokens", Value: "many"}, expectedError: "invalid syntax"},
+		{directive: directive{Key: "model", Value: ""}, expectedError: "empty model"},
+		{directive: directive{Line: 2, Key: "tmep", Value: "0.9"}, expectedError: "line 2: directive tmep=0.9: not a directive or an option"},
+	}
+	for _, tt := range tests {
+		s := requestSettings{model: "gpt-4", maxTokens: 100, temperature: 0.7, n: 1, opts: map[string]string{}}
+		err := s.apply(tt.directive)
+		if tt.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("%v: expected an error containing %q, got %v", tt.directive, tt.expectedError, err)
+			}
+			continue
+		}
+		if tt.expected.opts == nil {
+			tt.expected.opts = map[string]string{}
+		}
+		if err != nil || s.model != tt.expected.model || s.maxTokens != tt.expected.maxTokens || s.temperature != tt.expected.temperature ||
+			s.n != tt.expected.n || strings.Join(s.instructions, "|") != strings.Join(tt.expected.instructions, "|") || formatAIOptions(s.opts) != formatAIOptions(tt.expected.opts) {
+			t.Errorf("%v: expected %+v, got %+v, %v", tt.directive, tt.expected, s, err)
+		}
+	}
+}
+
+func TestCompleteTextDirectives(t *testing.T) {
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+	text := "Once upon a time\n//! temp=0.9\n//! stop=CHAPTER\n//! instruct: write in present tense\n// a note\n\nAI: gpt-4, 100, 0.500, 1, top_p=0.9"
+	got, entry, err := completeText(text, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Once upon a time\n// a note\n\nIt was a dark night.\n\nAI: gpt-4, 100, 0.500, 1, top_p=0.9"
+	if got != expected {
+		t.Errorf("Expected the directives to be removed, got %q", got)
+	}
+	req := f.requests[0]
+	if req.Temperature != 0.9 || req.Options["stop"] != "CHAPTER" || req.Options["top_p"] != "0.9" || req.System != "write in present tense" || req.Prompt != "Once upon a time\n\n" {
+		t.Errorf("Expected the directives to be applied, got %+v", req)
+	}
+	if entry.Temperature != 0.9 || strings.Join(entry.Directives, "|") != "temp=0.9|stop=CHAPTER|instruct: write in present tense" {
+		t.Errorf("Expected the journal to record the directives, got %+v", entry)
+	}
+
+	// A bad directive stops the request and stays in the document.
+	_, _, err = completeText("Once upon a time\n//! temp=hot\n\nAI: gpt-4, 100, 0.500, 1", "")
+	if err == nil || !strings.Contains(err.Error(), "line 2: directive temp=hot") || f.count() != 1 {
+		t.Errorf("Expected a directive error without a request, got %v", err)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+// "ficta export" turns finished documents into a manuscript: AI: lines,
+// author comments, directives, response separators, provenance markers and
+// schemas are removed just as they are from prompts, and the text is written
+// as Markdown, plain text, HTML or EPUB. A directory is exported as one
+// manuscript made of its documents, in natural order, so that "ch2.ait"
+// comes before "ch10.ait".
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportExtensions are the extensions of the documents exported from a
+// directory.
+var exportExtensions = map[string]bool{".ait": true, ".txt": true, ".md": true, ".markdown": true}
+
+// chapter is an exported document.
+type chapter struct {
+	title string
+	text  string // cleaned Markdown or plain text
+}
+
+// exportWriters write a manuscript, titled title, made of chapters in the
+// format of an output file extension.
+var exportWriters = map[string]func(w io.Writer, title string, chapters []chapter) error{
+	".md":       writeExportText,
+	".markdown": writeExportText,
+	".txt":      writeExportText,
+	".html":     writeExportHTML,
+	".htm":      writeExportHTML,
+	".epub":     writeExportEPUB,
+}
+
+// runExport implements the export subcommand:
+//
+//	ficta export output file|dir [file|dir ...]
+//
+// The format is chosen by the extension of output, or is Markdown on the
+// standard output if output is "-".
+func runExport(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: ficta export output.md|.txt|.html|.epub file|dir [file|dir ...]")
+	}
+	output := args[0]
+	write := writeExportText
+	if output != "-" {
+		var ok bool
+		if write, ok = exportWriters[strings.ToLower(filepath.Ext(output))]; !ok {
+			return fmt.Errorf("export: unknown format of %s, use .md, .txt, .html or .epub", output)
+		}
+	}
+	files, err := exportFiles(args[1:])
+	if err != nil {
+		return err
+	}
+	var chapters []chapter
+	for _, filename := range files {
+		text, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		clean, err := exportText(string(text), filename)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		chapters = append(chapters, chapter{title: chapterTitle(clean, filename), text: clean})
+	}
+	title := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+	if len(chapters) == 1 {
+		title = chapters[0].title
+	}
+	if output == "-" {
+		return write(os.Stdout, title, chapters)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := write(f, title, chapters); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("%d documents exported to %s\n", len(chapters), output)
+	return nil
+}
+
+// exportFiles returns the documents named by args: files as they are, and
+// the documents in directories in natural order.
+func exportFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, e := range entries {
+			name := e.Name()
+			ext := strings.ToLower(filepath.Ext(name))
+			if e.IsDir() || strings.HasPrefix(name, ".") || !exportExtensions[ext] ||
+				strings.HasSuffix(name, "."+compareExt) || strings.Contains(name, "."+sideFileInfix+".") || (backupExt != "" && ext == "."+strings.ToLower(backupExt)) {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+		if len(names) == 0 {
+			return nil, fmt.Errorf("export: no documents in %s", arg)
+		}
+		for _, name := range names {
+			files = append(files, filepath.Join(arg, name))
+		}
+	}
+	return files, nil
+}
+
+// naturalLess reports whether a sorts before b, comparing runs of digits by
+// their value and everything else without regard to case.
+func naturalLess(a, b string) bool {
+	x, y := strings.ToLower(a), strings.ToLower(b)
+	for x != "" && y != "" {
+		dx, dy := digitRun(x), digitRun(y)
+		if dx == "" || dy == "" {
+			if x[0] != y[0] {
+				return x[0] < y[0]
+			}
+			x, y = x[1:], y[1:]
+			continue
+		}
+		nx, ny := strings.TrimLeft(dx, "0"), strings.TrimLeft(dy, "0")
+		if len(nx) != len(ny) {
+			return len(nx) < len(ny)
+		}
+		if nx != ny {
+			return nx < ny
+		}
+		x, y = x[len(dx):], y[len(dy):]
+	}
+	if x != y {
+		return x == ""
+	}
+	return a < b
+}
+
+// digitRun returns the digits at the start of s.
+func digitRun(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// exportText returns text, the contents of the document filename, without
+// anything that isn't part of the manuscript, and logs any problems with its
+// comments.
+func exportText(text, filename string) (string, error) {
+	clean, warnings, err := manuscriptText(text, filename)
+	for _, w := range warnings {
+		log.Printf("%s: %s", filename, w)
+	}
+	return clean, err
+}
+
+// manuscriptText returns text, the contents of the document filename,
+// without anything that isn't part of the manuscript, such as its front
+// matter, and the problems with its comments. Runs of blank lines left behind are reduced to one.
+func manuscriptText(text, filename string) (string, []commentWarning, error) {
+	syntax, err := commentSyntaxFor(filename, text)
+	if err != nil {
+		return "", nil, err
+	}
+	front, text := splitFrontMatter(text)
+	fm, err := parseFrontMatter(front)
+	if err != nil {
+		return "", nil, err
+	}
+	text, _, err = extractDirectives(text, syntax)
+	if err != nil {
+		return "", nil, err
+	}
+	text, warnings := stripComments(removeModeline(text), syntax)
+	text, err = substituteVariables(removeInvisibleMarkers(text), fm.Vars)
+	if err != nil {
+		return "", nil, err
+	}
+	text, _, err = extractSchema(text, filepath.Dir(filename))
+	if err != nil {
+		return "", nil, err
+	}
+	// The trailer goes whether or not it parses; before it, only AI: lines
+	// do, since prose may happen to start with "AI:".
+	if part1, aiLine := findLastAILine(text); aiLine != "" {
+		text = part1 + text[len(part1)+len(aiLine):]
+	}
+	var kept []string
+	blank := true // drops blank lines at the start
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if _, _, _, _, err := parseAILine(strings.TrimSpace(line)); err == nil {
+			continue
+		}
+		if line == "" && blank {
+			continue
+		}
+		blank = line == ""
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n")) + "\n", warnings, nil
+}
+
+// chapterTitle returns the first heading of text, the cleaned document
+// filename, or the file's name without its extension.
+func chapterTitle(text, filename string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if level, heading := markdownHeading(line); level > 0 {
+			return heading
+		}
+	}
+	base := filepath.Base(filename)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// writeExportText writes the chapters as they are, separated by blank lines.
+func writeExportText(w io.Writer, title string, chapters []chapter) error {
+	for i, c := range chapters {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, c.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExportHTML writes the chapters as an HTML page with a section for
+// each.
+func writeExportHTML(w io.Writer, title string, chapters []chapter) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\" />\n<title>%s</title>\n</head>\n<body>\n", html.EscapeString(title))
+	for _, c := range chapters {
+		fmt.Fprintf(&b, "<section>\n%s</section>\n", markdownHTML(c.text))
+	}
+	b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeExportEPUB writes the chapters as an EPUB 3 book with a page and a
+// table of contents entry for each.
+func writeExportEPUB(w io.Writer, title string, chapters []chapter) error {
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(w)
+	// The mimetype must come first and be stored uncompressed.
+	files := []struct{ name, content string }{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", epubContainer},
+		{"OEBPS/content.opf", epubPackage(id, title, chapters, time.Now())},
+		{"OEBPS/nav.xhtml", epubNav(title, chapters)},
+	}
+	for i, c := range chapters {
+		files = append(files, struct{ name, content string }{"OEBPS/" + epubChapterName(i), epubPage(c.title, markdownHTML(c.text))})
+	}
+	for i, file := range files {
+		header := &zip.FileHeader{Name: file.name, Method: zip.Deflate}
+		if i == 0 {
+			header.Method = zip.Store
+		}
+		f, err := z.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, file.content); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+func epubChapterName(i int) string {
+	return fmt.Sprintf("chapter%d.xhtml", i+1)
+}
+
+// epubPackage returns the package document of a book.
+func epubPackage(id, title string, chapters []chapter, modified time.Time) string {
+	var manifest, spine strings.Builder
+	for i := range chapters {
+		fmt.Fprintf(&manifest, "    <item id=\"c%d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, epubChapterName(i))
+		fmt.Fprintf(&spine, "    <itemref idref=\"c%d\"/>\n", i+1)
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:uuid:%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:language>en</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+%s  </manifest>
+  <spine>
+%s  </spine>
+</package>
+`, id, html.EscapeString(title), modified.UTC().Format("2006-01-02T15:04:05Z"), manifest.String(), spine.String())
+}
+
+// epubNav returns the table of contents of a book.
+func epubNav(title string, chapters []chapter) string {
+	var b strings.Builder
+	b.WriteString("<nav epub:type=\"toc\">\n<ol>\n")
+	for i, c := range chapters {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", epubChapterName(i), html.EscapeString(c.title))
+	}
+	b.WriteString("</ol>\n</nav>\n")
+	return epubPage(title, b.String())
+}
+
+// epubPage returns an XHTML page with body.
+func epubPage(title, body string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>%s</title>
+</head>
+<body>
+%s</body>
+</html>
+`, html.EscapeString(title), body)
+}
+
+// newUUID returns a random UUID.
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// The inline Markdown understood by markdownHTML, and scene breaks.
+var (
+	strongPattern     = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*`)
+	emphasisPattern   = regexp.MustCompile(`\*(\S(?:.*?\S)?)\*`)
+	underlinePattern  = regexp.MustCompile(`(^|\W)_(\S(?:.*?\S)?)_(\W|$)`)
+	sceneBreakPattern = regexp.MustCompile(`^(?:(?:\*\s*){3,}|(?:-\s*){3,}|(?:_\s*){3,}|#)$`)
+)
+
+// markdownHTML converts the Markdown a story is likely to use to XHTML:
+// headings, paragraphs, block quotes, scene breaks and emphasis. Anything
+// else is text.
+func markdownHTML(text string) string {
+	var b strings.Builder
+	var para []string
+	quote := false
+	flush := func() {
+		if len(para) > 0 {
+			p := markdownInline(strings.Join(para, "\n"))
+			if quote {
+				fmt.Fprintf(&b, "<blockquote><p>%s</p></blockquote>\n", p)
+			} else {
+				fmt.Fprintf(&b, "<p>%s</p>\n", p)
+			}
+		}
+		para, quote = nil, false
+	}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if level, heading := markdownHeading(trimmed); level > 0 {
+			flush()
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", level, markdownInline(heading), level)
+			continue
+		}
+		switch {
+		case trimmed == "":
+			flush()
+		case sceneBreakPattern.MatchString(trimmed):
+			flush()
+			b.WriteString("<hr />\n")
+		case strings.HasPrefix(trimmed, ">"):
+			if !quote {
+				flush()
+			}
+			quote = true
+			para = append(para, strings.TrimSpace(strings.TrimPrefix(trimmed, ">")))
+		default:
+			if quote {
+				flush()
+			}
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// markdownHeading returns the level and text of the Markdown heading line,
+// or level 0 if it is not one.
+func markdownHeading(line string) (int, string) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0, ""
+	}
+	return level, strings.TrimSpace(line[level:])
+}
+
+// markdownInline escapes s and converts its emphasis to XHTML.
+func markdownInline(s string) string {
+	s = html.EscapeString(s)
+	s = strongPattern.ReplaceAllString(s, "<strong>$1</strong>")
+	s = emphasisPattern.ReplaceAllString(s, "<em>$1</em>")
+	return underlinePattern.ReplaceAllString(s, "$1<em>$2</em>$3")
+}
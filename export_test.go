@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	names := []string{"ch10.ait", "Ch2.ait", "ch1.ait", "ch02b.ait", "epilogue.ait", "ch2a.ait", "prologue.ait"}
+	sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	expected := "ch1.ait|Ch2.ait|ch2a.ait|ch02b.ait|ch10.ait|epilogue.ait|prologue.ait"
+	if got := strings.Join(names, "|"); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestExportText(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	tests := []struct {
+		name          string
+		filename      string
+		text          string
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "Plain text",
+			filename: "story.ait",
+			text:     "Once upon a time",
+			expected: "Once upon a time\n",
+		},
+		{
+			name:     "Comments, directives and the AI: line",
+			filename: "story.ait",
+			text: "// ficta: comments=c\n# Chapter 1\n//! temp=0.9\nOnce upon a time /* fix */\n\n// response 1 of 2\n\nThe fox ran.\n\n" +
+				"// response 2 of 2\n\nThe fox hid.\n\n// produced by gpt-4o\n\nAI: gpt-4o | gpt-4o-mini, 100, 0.700, 2\n",
+			expected: "# Chapter 1\nOnce upon a time\n\nThe fox ran.\n\nThe fox hid.\n",
+		},
+		{
+			name:     "Prose starting with AI:",
+			filename: "story.ait",
+			text:     "The chapter began:\nAI: the new frontier, as the papers called it.\n\nAI: gpt-4o, 100, 0.700, 1",
+			expected: "The chapter began:\nAI: the new frontier, as the papers called it.\n",
+		},
+		{
+			name:     "Malformed trailer",
+			filename: "story.ait",
+			text:     "Once upon a time.\n\nAI: gpt-4, 100",
+			expected: "Once upon a time.\n",
+		},
+		{
+			name:     "Markdown",
+			filename: "story.md",
+			text:     "<!--! instruct: be brief -->\n# Chapter 1\n\n<!-- a note -->\nIt was night. // not a comment\n\nAI: gpt-4o, 100, 0.700, 1",
+			expected: "# Chapter 1\n\nIt was night. // not a comment\n",
+		},
+		{
+			name:     "Provenance markers",
+			filename: "story.ait",
+			text:     "Once\n\n// ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z\nThe fox ran.\n// ficta-ai-end\n\nThen " + invisible("ficta-ai-begin gpt-4o 2024-05-01T12:31:00Z") + "it hid." + invisible("ficta-ai-end"),
+			expected: "Once\n\nThe fox ran.\n\nThen it hid.\n",
+		},
+		{
+			name:     "Schema",
+			filename: "story.ait",
+			text:     "Describe the hero.\n@SCHEMA\n{\"type\": \"object\"}\n@END\n",
+			expected: "Describe the hero.\n",
+		},
+		{
+			name:          "Bad directive",
+			filename:      "story.ait",
+			text:          "Once\n//! be brief",
+			expectedError: `line 2: unknown directive "be brief"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := exportText(tt.text, tt.filename)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("Expected an error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil || got != tt.expected {
+				t.Errorf("Expected %q, got %q, %v", tt.expected, got, err)
+			}
+		})
+	}
+}
+
+func TestMarkdownHTML(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{text: "# Chapter 1\n\nOnce upon a time\nthere was a fox.\n", expected: "<h1>Chapter 1</h1>\n<p>Once upon a time\nthere was a fox.</p>\n"},
+		{text: "## The *Fox* & the Hound", expected: "<h2>The <em>Fox</em> &amp; the Hound</h2>\n"},
+		{text: "It was **very** dark, *she* said, _twice_. snake_case_name", expected: "<p>It was <strong>very</strong> dark, <em>she</em> said, <em>twice</em>. snake_case_name</p>\n"},
+		{text: "Before\n\n* * *\n\nAfter", expected: "<p>Before</p>\n<hr />\n<p>After</p>\n"},
+		{text: "She read:\n> Dear Fox,\n> come home.\nThen wept.", expected: "<p>She read:</p>\n<blockquote><p>Dear Fox,\ncome home.</p></blockquote>\n<p>Then wept.</p>\n"},
+		{text: "#hashtag and 3 * 4 * 5", expected: "<p>#hashtag and 3 * 4 * 5</p>\n"},
+		{text: "<b>not a tag</b>", expected: "<p>&lt;b&gt;not a tag&lt;/b&gt;</p>\n"},
+	}
+	for _, tt := range tests {
+		if got := markdownHTML(tt.text); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.text, tt.expected, got)
+		}
+	}
+}
+
+func TestRunExport(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	dir := t.TempDir()
+	book := filepath.Join(dir, "book")
+	if err := os.Mkdir(book, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"ch10.ait":             "# The End\n\nThey lived.\n\nAI: gpt-4o, 100, 0.700, 1",
+		"ch2.ait":              "# Middle\n// todo\nThe fox ran.\n\nAI: gpt-4o, 100, 0.700, 1",
+		"ch1.ait":              "# Beginning\n\nOnce upon a time.\n\nAI: gpt-4o, 100, 0.700, 1",
+		"ch1.compare.md":       "# Comparison for ch1.ait",
+		"ch1.responses.ait":    "# Unused responses\n\nThe fox slept.",
+		".ficta-journal.jsonl": "{}",
+		"cover.png":            "",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(book, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "book.md")
+	if err := runExport([]string{out, book}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(out)
+	expected := "# Beginning\n\nOnce upon a time.\n\n# Middle\nThe fox ran.\n\n# The End\n\nThey lived.\n"
+	if string(got) != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	out = filepath.Join(dir, "book.html")
+	if err := runExport([]string{out, filepath.Join(book, "ch2.ait")}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = os.ReadFile(out)
+	if !strings.Contains(string(got), "<title>Middle</title>") || !strings.Contains(string(got), "<section>\n<h1>Middle</h1>\n<p>The fox ran.</p>\n</section>") {
+		t.Errorf("Unexpected HTML %q", got)
+	}
+
+	out = filepath.Join(dir, "book.epub")
+	if err := runExport([]string{out, book}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	expected = "mimetype|META-INF/container.xml|OEBPS/content.opf|OEBPS/nav.xhtml|OEBPS/chapter1.xhtml|OEBPS/chapter2.xhtml|OEBPS/chapter3.xhtml"
+	if strings.Join(names, "|") != expected || r.File[0].Method != zip.Store {
+		t.Errorf("Expected the files %s with an uncompressed mimetype, got %v", expected, names)
+	}
+	contents := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name] = string(data)
+	}
+	if !strings.Contains(contents["OEBPS/content.opf"], "<dc:title>book</dc:title>") ||
+		!strings.Contains(contents["OEBPS/nav.xhtml"], `<li><a href="chapter3.xhtml">The End</a></li>`) ||
+		!strings.Contains(contents["OEBPS/chapter2.xhtml"], "<h1>Middle</h1>\n<p>The fox ran.</p>") {
+		t.Errorf("Unexpected EPUB contents %v", contents)
+	}
+
+	if err := runExport([]string{filepath.Join(dir, "book.pdf"), book}); err == nil || !strings.Contains(err.Error(), "unknown format") {
+		t.Errorf("Expected an unknown format error, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// The model field of an AI: line may list several models separated by "|",
+// e.g. "local:llama3 | gpt-4o-mini". They are tried in order until one answers,
+// so a rate-limited model or a local server that is down doesn't stop work.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	fallbackModels string // -fb: models tried after those on the AI: line
+	fallbackStatus string // -fs: HTTP status codes that move on to the next model
+)
+
+// producedByTag starts the author comment that records which model of a
+// fallback chain produced a response.
+const producedByTag = "produced by"
+
+// modelChain splits the model field of an AI: line into the ordered list of
+// model specs to try, followed by the -fb fallbacks that aren't already
+// listed.
+func modelChain(model string) []string {
+	var chain []string
+	seen := make(map[string]bool)
+	for _, list := range []string{model, fallbackModels} {
+		for _, spec := range strings.Split(list, "|") {
+			spec = strings.TrimSpace(spec)
+			if spec != "" && !seen[spec] {
+				chain = append(chain, spec)
+				seen[spec] = true
+			}
+		}
+	}
+	return chain
+}
+
+// statusCodeText finds things that look like HTTP status codes in error text.
+var statusCodeText = regexp.MustCompile(`\b[1-5]\d\d\b`)
+
+// shouldFallBack reports whether err means the next model in the chain should
+// be tried: the endpoint couldn't be reached or answered with one of the -fs
+// status codes. Other errors, like a malformed request, would fail the same
+// way everywhere.
+func shouldFallBack(err error) bool {
+	codes := make(map[int]bool)
+	for _, f := range strings.Split(fallbackStatus, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(f)); err == nil {
+			codes[n] = true
+		}
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return codes[se.StatusCode]
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	// Errors from the goopenai client are plain text.
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"connection refused", "connection reset", "no such host", "timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	for _, m := range statusCodeText.FindAllString(msg, -1) {
+		if n, _ := strconv.Atoi(m); codes[n] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestModelChain(t *testing.T) {
+	defer func(fb string) { fallbackModels = fb }(fallbackModels)
+	tests := []struct {
+		model     string
+		fallbacks string
+		expected  []string
+	}{
+		{model: "gpt-4", expected: []string{"gpt-4"}},
+		{model: "url:llama3 | gpt-4o-mini", expected: []string{"url:llama3", "gpt-4o-mini"}},
+		{model: "url | gpt-4o-mini", fallbacks: "gpt-4o-mini|gpt-3.5-turbo", expected: []string{"url", "gpt-4o-mini", "gpt-3.5-turbo"}},
+	}
+	for _, tt := range tests {
+		fallbackModels = tt.fallbacks
+		if chain := modelChain(tt.model); !reflect.DeepEqual(chain, tt.expected) {
+			t.Errorf("modelChain(%q): expected %q, got %q", tt.model, tt.expected, chain)
+		}
+	}
+}
+
+func TestShouldFallBack(t *testing.T) {
+	defer func(fs string) { fallbackStatus = fs }(fallbackStatus)
+	fallbackStatus = "429, 503"
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{err: &statusError{StatusCode: 503}, expected: true},
+		{err: &statusError{StatusCode: 500}, expected: false},
+		{err: &statusError{StatusCode: 400}, expected: false},
+		{err: errors.New("dial tcp 127.0.0.1:8080: connect: connection refused"), expected: true},
+		{err: errors.New("error, status code: 429, message: Rate limit reached"), expected: true},
+		{err: errors.New("invalid request"), expected: false},
+	}
+	for _, tt := range tests {
+		if got := shouldFallBack(tt.err); got != tt.expected {
+			t.Errorf("shouldFallBack(%v) = %v", tt.err, got)
+		}
+	}
+}
+
+func TestAppendJournal(t *testing.T) {
+	defer func(j string) { journalName = j }(journalName)
+	journalName = "journal.jsonl"
+	dir := t.TempDir()
+	doc := filepath.Join(dir, "story.ait")
+	for _, model := range []string{"url | gpt-4", "gpt-4"} {
+		if err := appendJournal(doc, journalEntry{Model: model, UsedModel: "gpt-4"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, journalName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 || entries[0].File != "story.ait" || entries[0].Model != "url | gpt-4" {
+		t.Errorf("Unexpected journal entries %+v", entries)
+	}
+}
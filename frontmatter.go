@@ -0,0 +1,271 @@
+package main
+
+// A document may start with YAML front matter, settings for the whole
+// document that the AI: line can't hold:
+//
+//	---
+//	model: gpt-4o
+//	endpoint: local
+//	system: You are a patient editor.
+//	comments: html
+//	stop: [CHAPTER, THE END]
+//	context: last 2000
+//	output: side
+//	vars:
+//	  hero: Willy
+//	---
+//
+// The front matter is never sent and is written back as it is. Where the AI:
+// line and the front matter both set something, the AI: line wins.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontMatterDelimiter opens and closes the front matter.
+const frontMatterDelimiter = "---"
+
+// Context policies, set with the front matter's context.
+const (
+	contextFull = "full" // send the whole document
+	contextLast = "last" // "last N": send about the last N tokens
+)
+
+// Output modes, set with the front matter's output.
+const (
+	outputAppend = "append" // responses are added to the document
+	outputSide   = "side"   // responses are added to a side file
+)
+
+// sideFileInfix is added before the extension of a document to name its side
+// file, e.g. story.responses.ait.
+const sideFileInfix = "responses"
+
+// frontMatter holds a document's front matter settings.
+type frontMatter struct {
+	Model       string            `yaml:"model"`
+	Endpoint    string            `yaml:"endpoint"` // for models without one
+	MaxTokens   *int              `yaml:"max_tokens"`
+	Temperature *float64          `yaml:"temperature"`
+	N           *int              `yaml:"n"`
+	System      string            `yaml:"system"`   // the system prompt itself
+	Comments    string            `yaml:"comments"` // a comment profile
+	Stop        stringList        `yaml:"stop"`
+	Context     string            `yaml:"context"`
+	Output      string            `yaml:"output"`
+	Vars        map[string]string `yaml:"vars"`
+}
+
+// stringList is a YAML list of strings, or a single string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// splitFrontMatter splits text into its front matter, including the
+// delimiter lines, and the rest. front is "" if text has none.
+func splitFrontMatter(text string) (front, rest string) {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) < 2 || strings.TrimRight(lines[0], " \t\r\n") != frontMatterDelimiter {
+		return "", text
+	}
+	n := len(lines[0])
+	for _, line := range lines[1:] {
+		n += len(line)
+		if t := strings.TrimRight(line, " \t\r\n"); t == frontMatterDelimiter || t == "..." {
+			return text[:n], text[n:]
+		}
+	}
+	// Without a closing line, the first line is text, e.g. a scene break.
+	return "", text
+}
+
+// removeFrontMatter removes text's front matter, which is never part of a
+// prompt.
+func removeFrontMatter(text string) string {
+	_, rest := splitFrontMatter(text)
+	return rest
+}
+
+// parseFrontMatter returns the settings of front, the front matter found by
+// splitFrontMatter.
+func parseFrontMatter(front string) (frontMatter, error) {
+	var fm frontMatter
+	if front == "" {
+		return fm, nil
+	}
+	lines := strings.Split(strings.TrimRight(front, "\r\n"), "\n")
+	body := strings.Join(lines[1:len(lines)-1], "\n")
+	dec := yaml.NewDecoder(strings.NewReader(body))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fm); err != nil && !errors.Is(err, io.EOF) {
+		return fm, fmt.Errorf("front matter: %w", err)
+	}
+	// The same bounds as the AI: line's.
+	if fm.MaxTokens != nil && *fm.MaxTokens < 0 {
+		return fm, fmt.Errorf("front matter: max_tokens %d: must be 0 or more", *fm.MaxTokens)
+	}
+	if fm.Temperature != nil && (*fm.Temperature < 0 || *fm.Temperature > 1) {
+		return fm, fmt.Errorf("front matter: temperature %g: must be between 0 and 1", *fm.Temperature)
+	}
+	if fm.N != nil && *fm.N <= 0 {
+		return fm, fmt.Errorf("front matter: n %d: must be 1 or more", *fm.N)
+	}
+	if fm.Endpoint != "" {
+		if _, ok := lookupEndpoint(fm.Endpoint); !ok {
+			return fm, fmt.Errorf("front matter: unknown endpoint %q", fm.Endpoint)
+		}
+	}
+	if fm.Comments != "" {
+		if _, ok := commentProfiles[fm.Comments]; !ok {
+			return fm, fmt.Errorf("front matter: unknown comment profile %q, use %s", fm.Comments, strings.Join(sortedKeys(commentProfiles), ", "))
+		}
+	}
+	if _, err := fm.contextLimit(); err != nil {
+		return fm, err
+	}
+	switch fm.Output {
+	case "", outputAppend, outputSide:
+	default:
+		return fm, fmt.Errorf("front matter: unknown output %q, use %s or %s", fm.Output, outputAppend, outputSide)
+	}
+	return fm, nil
+}
+
+// frontMatterComments returns the comment profile named by text's front
+// matter, if it names one.
+func frontMatterComments(text string) (string, bool) {
+	front, _ := splitFrontMatter(text)
+	if front == "" {
+		return "", false
+	}
+	fm, err := parseFrontMatter(front)
+	if err != nil || fm.Comments == "" {
+		return "", false
+	}
+	return fm.Comments, true
+}
+
+// contextLimit returns the number of tokens the context policy allows, 0
+// for no limit.
+func (fm frontMatter) contextLimit() (int, error) {
+	fields := strings.Fields(fm.Context)
+	switch {
+	case len(fields) == 0 || (len(fields) == 1 && fields[0] == contextFull):
+		return 0, nil
+	case len(fields) == 2 && fields[0] == contextLast:
+		n, err := strconv.Atoi(fields[1])
+		if err == nil && n > 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("front matter: unknown context %q, use %q or %q", fm.Context, contextFull, contextLast+" N")
+}
+
+// settings applies fm to the settings s given by a document's AI: line, of
+// which aiLineOK says whether it was there and valid. The options of the AI:
+// line have already been set.
+func (fm frontMatter) settings(s requestSettings, aiLineOK bool) requestSettings {
+	if !aiLineOK {
+		if fm.Model != "" {
+			s.model = fm.Model
+		}
+		if fm.MaxTokens != nil {
+			s.maxTokens = *fm.MaxTokens
+		}
+		if fm.Temperature != nil {
+			s.temperature = *fm.Temperature
+		}
+		if fm.N != nil {
+			s.n = *fm.N
+		} else if fm.Model != "" {
+			// Not the two responses of a malformed AI: line.
+			s.n = 1
+		}
+	}
+	if _, ok := s.opts["stop"]; !ok && len(fm.Stop) > 0 {
+		// Commas separate AI: line fields, so stop sequences are
+		// separated by '|' as they would be there.
+		s.opts["stop"] = strings.Join(fm.Stop, "|")
+	}
+	return s
+}
+
+// withEndpoint returns model, a model or fallback chain, with each model that
+// doesn't name an endpoint sent to the endpoint named name.
+func withEndpoint(model, name string) string {
+	if name == "" {
+		return model
+	}
+	specs := strings.Split(model, "|")
+	for i := range specs {
+		spec := strings.TrimSpace(specs[i])
+		specs[i] = spec
+		prefix, _, hasPrefix := strings.Cut(spec, ":")
+		if _, ok := lookupEndpoint(prefix); ok && hasPrefix {
+			continue
+		}
+		if _, ok := lookupEndpoint(spec); ok {
+			continue
+		}
+		specs[i] = name + ":" + spec
+	}
+	return strings.Join(specs, " | ")
+}
+
+// limitContext returns the end of prompt that fits in about limit tokens,
+// starting at a line, or all of it if limit is 0 or it fits.
+func limitContext(prompt string, limit int) string {
+	if limit == 0 || estimateTokens(prompt) <= limit {
+		return prompt
+	}
+	runes := []rune(prompt)
+	tail := string(runes[len(runes)-4*limit:])
+	if i := strings.Index(tail, "\n"); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+	return tail
+}
+
+// sideFile returns the name of the side file of the document filename.
+func sideFile(filename string) string {
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	if ext == "" {
+		return filename + "." + sideFileInfix
+	}
+	return replaceExtension(filename, sideFileInfix+"."+ext)
+}
+
+// appendSideFile adds responses to the side file of the document filename.
+func appendSideFile(filename, responses string) error {
+	if filename == "" {
+		return fmt.Errorf("front matter: output %s needs a file name", outputSide)
+	}
+	f, err := os.OpenFile(sideFile(filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(responses + "\n\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
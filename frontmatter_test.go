@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		front string
+	}{
+		{name: "Front matter", text: "---\nmodel: gpt-4\n---\nOnce upon a time", front: "---\nmodel: gpt-4\n---\n"},
+		{name: "Closed with dots", text: "---\nmodel: gpt-4\n...\nOnce", front: "---\nmodel: gpt-4\n...\n"},
+		{name: "Empty", text: "---\n---\nOnce", front: "---\n---\n"},
+		{name: "CRLF", text: "---\r\nn: 1\r\n---\r\nOnce", front: "---\r\nn: 1\r\n---\r\n"},
+		{name: "Not closed", text: "---\nA scene break.", front: ""},
+		{name: "Not at the start", text: "Once\n---\nmodel: gpt-4\n---\n", front: ""},
+		{name: "No front matter", text: "Once upon a time", front: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			front, rest := splitFrontMatter(tt.text)
+			if front != tt.front || front+rest != tt.text {
+				t.Errorf("Expected %q, got %q and %q", tt.front, front, rest)
+			}
+		})
+	}
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	temperature := 0.2
+	tests := []struct {
+		name          string
+		front         string
+		expected      frontMatter
+		expectedError string
+	}{
+		{name: "None", front: ""},
+		{name: "Empty", front: "---\n---\n"},
+		{
+			name:  "Settings",
+			front: "---\nmodel: gpt-4\nendpoint: ollama\ntemperature: 0.2\nsystem: Be brief.\ncomments: html\nstop: [THE END, CHAPTER]\ncontext: last 100\noutput: side\nvars:\n  hero: Willy\n---\n",
+			expected: frontMatter{Model: "gpt-4", Endpoint: "ollama", Temperature: &temperature, System: "Be brief.", Comments: "html",
+				Stop: stringList{"THE END", "CHAPTER"}, Context: "last 100", Output: outputSide, Vars: map[string]string{"hero": "Willy"}},
+		},
+		{name: "Single stop", front: "---\nstop: THE END\n---\n", expected: frontMatter{Stop: stringList{"THE END"}}},
+		{name: "Unknown key", front: "---\nmodle: gpt-4\n---\n", expectedError: "field modle not found"},
+		{name: "Not YAML", front: "---\nmodel: [gpt-4\n---\n", expectedError: "front matter:"},
+		{name: "Negative max_tokens", front: "---\nmax_tokens: -3\n---\n", expectedError: "front matter: max_tokens -3: must be 0 or more"},
+		{name: "Temperature too high", front: "---\ntemperature: 5\n---\n", expectedError: "front matter: temperature 5: must be between 0 and 1"},
+		{name: "Negative temperature", front: "---\ntemperature: -0.1\n---\n", expectedError: "front matter: temperature -0.1: must be between 0 and 1"},
+		{name: "No responses", front: "---\nn: 0\n---\n", expectedError: "front matter: n 0: must be 1 or more"},
+		{name: "Unknown endpoint", front: "---\nendpoint: nowhere\n---\n", expectedError: `unknown endpoint "nowhere"`},
+		{name: "Unknown comments", front: "---\ncomments: lisp\n---\n", expectedError: `unknown comment profile "lisp", use c, html, latex, org`},
+		{name: "Unknown context", front: "---\ncontext: first 10\n---\n", expectedError: `unknown context "first 10"`},
+		{name: "Bad context", front: "---\ncontext: last -1\n---\n", expectedError: `unknown context "last -1"`},
+		{name: "Unknown output", front: "---\noutput: replace\n---\n", expectedError: `unknown output "replace", use append or side`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFrontMatter(tt.front)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("Expected an error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %+v, got %+v, %v", tt.expected, got, err)
+			}
+		})
+	}
+}
+
+func TestWithEndpoint(t *testing.T) {
+	tests := []struct {
+		model, name, expected string
+	}{
+		{"gpt-4", "", "gpt-4"},
+		{"llama3", "ollama", "ollama:llama3"},
+		{"openai:gpt-4", "ollama", "openai:gpt-4"},
+		{"llamacpp", "ollama", "llamacpp"},
+		{"llama3 | openai:gpt-4|mistral", "ollama", "ollama:llama3 | openai:gpt-4 | ollama:mistral"},
+	}
+	for _, tt := range tests {
+		if got := withEndpoint(tt.model, tt.name); got != tt.expected {
+			t.Errorf("withEndpoint(%q, %q): expected %q, got %q", tt.model, tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestLimitContext(t *testing.T) {
+	prompt := "The first line is long enough.\nThe second.\nThe third line."
+	tests := []struct {
+		limit    int
+		expected string
+	}{
+		{0, prompt},
+		{100, prompt},
+		{6, "The third line."},
+		{8, "The second.\nThe third line."},
+	}
+	for _, tt := range tests {
+		if got := limitContext(prompt, tt.limit); got != tt.expected {
+			t.Errorf("limitContext(%d): expected %q, got %q", tt.limit, tt.expected, got)
+		}
+	}
+}
+
+func TestCompleteTextFrontMatter(t *testing.T) {
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+	front := "---\nmodel: gpt-4o\nmax_tokens: 50\nn: 1\nsystem: Be brief.\ncomments: html\nstop: [THE END, CHAPTER]\nvars:\n  hero: Willy\n---\n"
+
+	got, entry, err := completeText(front+"<!-- a note -->\nOnce upon a time {{hero}} ran.\n\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := front + "<!-- a note -->\nOnce upon a time {{hero}} ran.\n\nIt was a dark night.\n\nAI: gpt-4o, 50, 0.700, 1"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	req := f.requests[0]
+	if req.Prompt != "Once upon a time Willy ran.\n\n" || req.System != "Be brief." || req.Options["stop"] != "THE END|CHAPTER" || req.MaxTokens != 50 {
+		t.Errorf("Expected the front matter to be applied, got %+v", req)
+	}
+	if entry.Model != "gpt-4o" {
+		t.Errorf("Expected the front matter's model, got %q", entry.Model)
+	}
+
+	// The AI: line wins over the front matter.
+	_, _, err = completeText(front+"Once upon a time.\n\nAI: gpt-4, 100, 0.500, 1, stop=FIN, system="+filepath.Join("testdata", "none"), "")
+	if err == nil || !strings.Contains(err.Error(), "option system=") {
+		t.Errorf("Expected the AI: line's system prompt to be read, got %v", err)
+	}
+	_, entry, err = completeText(front+"Once upon a time.\n\nAI: gpt-4, 100, 0.500, 1, stop=FIN", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := f.requests[len(f.requests)-1]; entry.Model != "gpt-4" || req.MaxTokens != 100 || req.Options["stop"] != "FIN" {
+		t.Errorf("Expected the AI: line's settings, got %q and %+v", entry.Model, req)
+	}
+
+	n := f.count()
+	_, _, err = completeText("---\nmodle: gpt-4\n---\nOnce upon a time.\n\nAI: gpt-4, 100, 0.500, 1", "")
+	if err == nil || !strings.Contains(err.Error(), "front matter:") || f.count() != n {
+		t.Errorf("Expected a front matter error without a request, got %v", err)
+	}
+}
+
+func TestCompleteTextFrontMatterRequest(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	var (
+		requests []ollamaRequest
+		paths    []string
+	)
+	server := ollamaStandIn(t, &requests, &paths)
+	defer server.Close()
+	writeTestConfig(t, `{"endpoints": {"local": {"url": "`+server.URL+`", "provider": "ollama"}}}`)
+
+	// Without an AI: line or n, the front matter's model gets one request.
+	got, _, err := completeText("---\nmodel: local:llama3\nstop: [THE END, CHAPTER]\n---\nOnce upon a time.\n\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || strings.Contains(got, "response 2 of") {
+		t.Fatalf("Expected one request and response, got %d and %q", len(requests), got)
+	}
+	if stop, _ := requests[0].Options["stop"].([]interface{}); len(stop) != 2 || stop[0] != "THE END" || stop[1] != "CHAPTER" {
+		t.Errorf("Expected the front matter's stop sequences, got %v", requests[0].Options["stop"])
+	}
+}
+
+func TestCompleteTextSideOutput(t *testing.T) {
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+	filename := filepath.Join(t.TempDir(), "story.ait")
+	text := "---\noutput: side\n---\nOnce upon a time.\n\nAI: gpt-4, 100, 0.500, 1"
+	for i := 0; i < 2; i++ {
+		got, _, err := completeText(text, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != text {
+			t.Errorf("Expected the document to be unchanged, got %q", got)
+		}
+	}
+	side, err := os.ReadFile(filepath.Join(filepath.Dir(filename), "story.responses.ait"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(side) != "It was a dark night.\n\nIt was a dark night.\n\n" {
+		t.Errorf("Expected the responses in the side file, got %q", side)
+	}
+	if _, _, err := completeText(text, ""); err == nil {
+		t.Error("Expected an error for a side file without a file name")
+	}
+}
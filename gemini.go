@@ -0,0 +1,197 @@
+package main
+
+// Endpoints with "provider": "gemini" speak Google's Gemini API, whose
+// generateContent and streamGenerateContent methods take the conversation as
+// "contents" of "parts" and the sampling settings in a generationConfig.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// geminiContent is a message: a role and its parts.
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"` // "user" or "model"
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+// geminiRequest is the body of a generateContent request.
+type geminiRequest struct {
+	Contents          []geminiContent        `json:"contents"`
+	SystemInstruction *geminiContent         `json:"systemInstruction,omitempty"`
+	GenerationConfig  map[string]interface{} `json:"generationConfig"`
+}
+
+// geminiResponse is a generateContent response or one chunk of a streamed
+// one.
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+		Index        int           `json:"index"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+}
+
+// geminiOptions are the AI: line options of Gemini endpoints and the
+// generationConfig fields they are sent as. stream picks the method instead.
+var geminiOptions = map[string]optionSpec{
+	"stream":            {"", optionBool},
+	"top_p":             {"topP", optionFloat},
+	"top_k":             {"topK", optionInt},
+	"seed":              {"seed", optionInt},
+	"stop":              {"stopSequences", optionList},
+	"presence_penalty":  {"presencePenalty", optionFloat},
+	"frequency_penalty": {"frequencyPenalty", optionFloat},
+}
+
+// geminiCompleter sends requests to the Gemini API. N is sent as the
+// candidate count, so one request returns all the completions.
+type geminiCompleter struct{}
+
+func (geminiCompleter) Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error) {
+	var result completion
+	r, stream, err := geminiRequestFor(req, ep.temperature(req))
+	if err != nil {
+		return result, err
+	}
+	key, err := ep.apiKey()
+	if err != nil {
+		return result, err
+	}
+	headers := map[string]string{"x-goog-api-key": key}
+	url := strings.TrimSuffix(ep.URL, "/") + "/v1beta/models/" + req.Model
+	if stream {
+		url += ":streamGenerateContent?alt=sse"
+	} else {
+		url += ":generateContent"
+	}
+	err = withRetries(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = geminiPost(ctx, url, headers, r, stream)
+		return err
+	})
+	if err != nil {
+		return completion{}, err
+	}
+	log.Printf("tokens: prompt=%d, completion=%d, total=%d\n", result.PromptTokens, result.CompletionTokens, result.PromptTokens+result.CompletionTokens)
+	return result, nil
+}
+
+// geminiRequestFor builds the request body for req, with the given
+// temperature, and reports whether the response should be streamed.
+func geminiRequestFor(req completionRequest, temperature float64) (*geminiRequest, bool, error) {
+	r := &geminiRequest{
+		Contents: []geminiContent{{Role: "user", Parts: []geminiPart{{Text: req.Prompt}}}},
+		GenerationConfig: map[string]interface{}{
+			"temperature":     temperature,
+			"maxOutputTokens": req.MaxTokens,
+			"candidateCount":  req.N,
+		},
+	}
+	if req.Schema != nil {
+		// Gemini's responseSchema takes only part of JSON Schema, so the
+		// response is just asked to be JSON and checked afterwards.
+		r.GenerationConfig["responseMimeType"] = "application/json"
+	}
+	if req.System != "" {
+		r.SystemInstruction = &geminiContent{Parts: []geminiPart{{Text: req.System}}}
+	}
+	stream := false
+	for k, v := range req.Options {
+		spec, err := lookupOption(providerGemini, geminiOptions, k)
+		if err != nil {
+			return nil, false, err
+		}
+		value, err := spec.value(v)
+		if k == "stream" {
+			stream = err == nil && value.(bool)
+		} else {
+			r.GenerationConfig[spec.field] = value
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("option %s=%s: %w", k, v, err)
+		}
+	}
+	return r, stream, nil
+}
+
+// geminiPost sends r and returns the completions. A streamed response
+// arrives as server-sent events, each holding the next piece of one or more
+// candidates, which are assembled by candidate index.
+func geminiPost(ctx context.Context, url string, headers map[string]string, r *geminiRequest, stream bool) (completion, error) {
+	var result completion
+	resp, err := postJSON(ctx, url, headers, r)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	var texts []string
+	add := func(gr geminiResponse) error {
+		if gr.PromptFeedback.BlockReason != "" {
+			return fmt.Errorf("gemini: prompt blocked: %s", gr.PromptFeedback.BlockReason)
+		}
+		for _, c := range gr.Candidates {
+			for len(texts) <= c.Index {
+				texts = append(texts, "")
+			}
+			for _, p := range c.Content.Parts {
+				texts[c.Index] += p.Text
+			}
+		}
+		// Chunks report the usage so far.
+		if gr.UsageMetadata.PromptTokenCount > 0 {
+			result.PromptTokens = gr.UsageMetadata.PromptTokenCount
+			result.CompletionTokens = gr.UsageMetadata.CandidatesTokenCount
+		}
+		return nil
+	}
+	if !stream {
+		var gr geminiResponse
+		if err := json.NewDecoder(resp.Body).Decode(&gr); err != nil {
+			return result, err
+		}
+		if err := add(gr); err != nil {
+			return result, err
+		}
+	} else {
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var gr geminiResponse
+			if err := json.Unmarshal([]byte(data), &gr); err != nil {
+				return result, err
+			}
+			if err := add(gr); err != nil {
+				return result, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return result, err
+		}
+	}
+	if len(texts) == 0 {
+		return result, errors.New("gemini: no candidates in the response")
+	}
+	result.Choices = texts
+	return result, nil
+}
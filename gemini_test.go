@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGeminiCompleter(t *testing.T) {
+	var (
+		bodies []geminiRequest
+		paths  []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-goog-api-key") != "test-key" {
+			t.Errorf("Missing API key header in %v", r.Header)
+		}
+		var body geminiRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		bodies = append(bodies, body)
+		paths = append(paths, r.URL.Path)
+		if strings.Contains(r.URL.Path, "blocked") {
+			fmt.Fprint(w, `{"promptFeedback": {"blockReason": "SAFETY"}}`)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, ":streamGenerateContent") {
+			fmt.Fprint(w, `{"candidates": [
+				{"content": {"role": "model", "parts": [{"text": "Rain fell."}]}, "index": 0},
+				{"content": {"role": "model", "parts": [{"text": "Snow fell."}]}, "index": 1}],
+				"usageMetadata": {"promptTokenCount": 6, "candidatesTokenCount": 8}}`)
+			return
+		}
+		if r.URL.Query().Get("alt") != "sse" {
+			t.Errorf("Expected alt=sse, got %s", r.URL.RawQuery)
+		}
+		for i, chunk := range []string{"Rain", " fell."} {
+			fmt.Fprintf(w, `data: {"candidates": [{"content": {"parts": [{"text": %q}]}, "index": 0}], "usageMetadata": {"promptTokenCount": 6, "candidatesTokenCount": %d}}`+"\n\n", chunk, 2*i+2)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("FICTA_TEST_GEMINI_KEY", "test-key")
+	ep := &endpoint{Name: "gemini", URL: server.URL, Provider: providerGemini, Auth: authConfig{Type: authEnv, Env: "FICTA_TEST_GEMINI_KEY"}}
+
+	req := completionRequest{
+		Model:       "gemini-1.5-flash",
+		Prompt:      "The weather",
+		System:      "You are a poet.",
+		MaxTokens:   100,
+		Temperature: 0.4,
+		N:           2,
+		Options:     map[string]string{"top_k": "20", "stop": "THE END|\n\n\n"},
+	}
+	c, err := geminiCompleter{}.Complete(context.Background(), ep, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Choices) != 2 || c.Choices[1] != "Snow fell." || c.PromptTokens != 6 || c.CompletionTokens != 8 {
+		t.Errorf("Unexpected result %+v", c)
+	}
+	if paths[0] != "/v1beta/models/gemini-1.5-flash:generateContent" {
+		t.Errorf("Unexpected path %s", paths[0])
+	}
+	cfg := bodies[0].GenerationConfig
+	if cfg["temperature"] != 0.8 || cfg["maxOutputTokens"] != float64(100) || cfg["candidateCount"] != float64(2) || cfg["topK"] != float64(20) {
+		t.Errorf("Unexpected generationConfig %v", cfg)
+	}
+	if stops, _ := cfg["stopSequences"].([]interface{}); len(stops) != 2 {
+		t.Errorf("Expected two stop sequences, got %v", cfg["stopSequences"])
+	}
+	if si := bodies[0].SystemInstruction; si == nil || si.Parts[0].Text != "You are a poet." {
+		t.Errorf("Expected the system instruction, got %+v", si)
+	}
+
+	req.N = 1
+	req.Options = map[string]string{"stream": "true"}
+	c, err = geminiCompleter{}.Complete(context.Background(), ep, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Choices) != 1 || c.Choices[0] != "Rain fell." || c.CompletionTokens != 4 {
+		t.Errorf("Unexpected streamed result %+v", c)
+	}
+
+	n := len(bodies)
+	req.Options = map[string]string{"presencePenalty": "0.5"}
+	if _, err := (geminiCompleter{}).Complete(context.Background(), ep, req); err == nil || !strings.Contains(err.Error(), "option presencePenalty: not an option of gemini endpoints") || len(bodies) != n {
+		t.Errorf("Expected an unknown option error without a request, got %v", err)
+	}
+
+	req.Model = "blocked"
+	req.Options = nil
+	if _, err := (geminiCompleter{}).Complete(context.Background(), ep, req); err == nil || !strings.Contains(err.Error(), "SAFETY") {
+		t.Errorf("Expected a blocked prompt error, got %v", err)
+	}
+}
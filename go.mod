@@ -7,6 +7,7 @@ replace github.com/Michael-F-Ellis/goopenai v1.2.2 => ../goopenai
 require (
 	github.com/Michael-F-Ellis/goopenai v1.2.2
 	github.com/fsnotify/fsnotify v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,103 @@
+package main
+
+// Hook commands let authors post-process prompts and responses with ordinary
+// shell filters. A hook reads text on stdin and writes the replacement text to
+// stdout.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Hook failure policies, selected with -hf.
+const (
+	hookPolicySkip  = "skip"  // log the failure and use the unmodified text
+	hookPolicyAbort = "abort" // log the failure and cancel the request
+)
+
+var (
+	preHook       string        // command that may rewrite the cleaned prompt
+	postHook      string        // command that may rewrite each response
+	hookTimeout   time.Duration // maximum run time of a hook command
+	hookPolicy    string        // what to do when a hook fails
+	errHookAbort  = errors.New("hook failed, request abandoned")
+	errHookOutput = errors.New("hook produced no output")
+)
+
+// runPreHook passes the cleaned prompt through the pre-hook command, if any.
+func runPreHook(prompt, model string) (string, error) {
+	return applyHook("pre", preHook, prompt, model)
+}
+
+// runPostHook passes a response through the post-hook command, if any.
+func runPostHook(response, model string) (string, error) {
+	return applyHook("post", postHook, response, model)
+}
+
+// applyHook runs command with text on stdin and returns its output. If the
+// command fails, the hook policy decides whether the original text is used
+// or errHookAbort is returned. Either way the file is never written with the
+// output of a failed hook.
+func applyHook(name, command, text, model string) (string, error) {
+	if command == "" {
+		return text, nil
+	}
+	out, err := runHook(command, text, hookTimeout, "FICTA_HOOK="+name, "FICTA_MODEL="+model)
+	if err == nil {
+		return out, nil
+	}
+	log.Printf("%s-hook %q: %v", name, command, err)
+	if hookPolicy == hookPolicyAbort {
+		return "", fmt.Errorf("%s-%w", name, errHookAbort)
+	}
+	log.Printf("%s-hook skipped, using unmodified text", name)
+	return text, nil
+}
+
+// runHook runs command through the system shell with input on stdin and
+// returns what it wrote to stdout. The command is killed if it runs longer
+// than timeout. A command that succeeds without writing anything is treated
+// as a failure, since an empty prompt or response is never what was meant.
+func runHook(command, input string, timeout time.Duration, env ...string) (string, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	// Don't let grandchildren that inherited stdout keep us waiting forever.
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	if strings.TrimSpace(stdout.String()) == "" {
+		return "", errHookOutput
+	}
+	return stdout.String(), nil
+}
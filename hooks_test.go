@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests use POSIX shell commands")
+	}
+	tests := []struct {
+		name        string
+		command     string
+		input       string
+		expected    string
+		expectedErr string
+	}{
+		{name: "Filter", command: "tr a-z A-Z", input: "hello", expected: "HELLO"},
+		{name: "Environment", command: `printf %s "$FICTA_HOOK"`, input: "x", expected: "test"},
+		{name: "Failure", command: "echo oops >&2; exit 3", input: "x", expectedErr: "oops"},
+		{name: "No output", command: "cat >/dev/null", input: "x", expectedErr: errHookOutput.Error()},
+		{name: "Timeout", command: "sleep 5", input: "x", expectedErr: "timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runHook(tt.command, tt.input, 200*time.Millisecond, "FICTA_HOOK=test")
+			if tt.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if out != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestApplyHookPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests use POSIX shell commands")
+	}
+	defer func(p string, d time.Duration) { hookPolicy, hookTimeout = p, d }(hookPolicy, hookTimeout)
+	hookTimeout = time.Second
+
+	hookPolicy = hookPolicySkip
+	out, err := applyHook("post", "exit 1", "original", "gpt-4")
+	if err != nil || out != "original" {
+		t.Errorf("skip policy: expected original text, got %q, %v", out, err)
+	}
+
+	hookPolicy = hookPolicyAbort
+	_, err = applyHook("post", "exit 1", "original", "gpt-4")
+	if !errors.Is(err, errHookAbort) {
+		t.Errorf("abort policy: expected errHookAbort, got %v", err)
+	}
+
+	out, err = applyHook("pre", "", "unchanged", "gpt-4")
+	if err != nil || out != "unchanged" {
+		t.Errorf("no hook: expected unchanged text, got %q, %v", out, err)
+	}
+}
+
+func TestReportRequestErrorAbort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests use POSIX shell commands")
+	}
+	defer func(pre, p string, d time.Duration) { preHook, hookPolicy, hookTimeout = pre, p, d }(preHook, hookPolicy, hookTimeout)
+	preHook, hookPolicy, hookTimeout = "exit 1", hookPolicyAbort, time.Second
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+	filename := filepath.Join(t.TempDir(), "story.ait")
+	text := "Text\n\nAI: gpt-4, 100, 0.5, 1"
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := requestCompletion(filename)
+	if !errors.Is(err, errHookAbort) {
+		t.Fatalf("Expected errHookAbort, got %v", err)
+	}
+	written, err := reportRequestError(filename, err)
+	if written || err != nil {
+		t.Errorf("Expected the file not to be written, got %v, %v", written, err)
+	}
+	if got, _ := os.ReadFile(filename); string(got) != text || f.count() != 0 {
+		t.Errorf("Expected the file to be unchanged without a request, got %q", got)
+	}
+
+	// Other errors are noted in the file.
+	written, err = reportRequestError(filename, errors.New("429 Too Many Requests"))
+	if got, _ := os.ReadFile(filename); !written || err != nil || !strings.Contains(string(got), "// ficta error: 429 Too Many Requests\nAI:") {
+		t.Errorf("Expected an error note, got %q, %v", got, err)
+	}
+}
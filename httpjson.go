@@ -0,0 +1,71 @@
+package main
+
+// Helpers for the endpoints ficta talks to directly over HTTP rather than
+// through the goopenai client.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// postJSON POSTs body, encoded as JSON, to url with the given extra headers.
+// A response with an error status is returned as a *statusError, so that
+// withRetries and shouldFallBack can tell what went wrong. On success the
+// caller must close the response body.
+func postJSON(ctx context.Context, url string, headers map[string]string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	if showJsonReq {
+		log.Print(string(data))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &statusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Message:    errorMessage(msg),
+		}
+	}
+	return resp, nil
+}
+
+// errorMessage extracts a readable message from an error response body.
+// Most servers send {"error": "..."} or {"error": {"message": "..."}}.
+func errorMessage(body []byte) string {
+	var e struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && len(e.Error) > 0 {
+		var s string
+		if json.Unmarshal(e.Error, &s) == nil {
+			return s
+		}
+		var m struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(e.Error, &m) == nil && m.Message != "" {
+			return m.Message
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
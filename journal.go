@@ -0,0 +1,61 @@
+package main
+
+// The journal is a JSON Lines file, kept next to the documents, with one
+// entry per completion request. It records what was asked for, which model
+// actually answered and what it cost in tokens.
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalName is the file name of the journal in each document's directory,
+// set with -J. An empty name disables the journal.
+var journalName string
+
+// journalEntry describes one completion request.
+type journalEntry struct {
+	Time             time.Time `json:"time"`
+	File             string    `json:"file"`
+	Model            string    `json:"model"`                // the model field of the AI: line
+	UsedModel        string    `json:"used_model,omitempty"` // the model that produced the response
+	MaxTokens        int       `json:"max_tokens"`
+	Temperature      float64   `json:"temperature"`               // normalized, 0 to 1
+	RawTemperature   *float64  `json:"raw_temperature,omitempty"` // as sent to the model that answered
+	N                int       `json:"n"`
+	Directives       []string  `json:"directives,omitempty"` // applied to this request only
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	Cached           bool      `json:"cached,omitempty"` // answered from the response cache
+	Elapsed          float64   `json:"elapsed"`          // seconds
+	Words            int       `json:"words,omitempty"`  // of the document after the response, see countWords
+	Error            string    `json:"error,omitempty"`
+}
+
+// journalPath returns the path of the journal for the document filename.
+func journalPath(filename string) string {
+	return filepath.Join(filepath.Dir(filename), journalName)
+}
+
+// appendJournal adds entry to the journal of the document filename.
+func appendJournal(filename string, entry journalEntry) error {
+	if journalName == "" {
+		return nil
+	}
+	entry.File = filepath.Base(filename)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(journalPath(filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,214 @@
+package main
+
+// Endpoints with "provider": "llamacpp" are sent the document as a plain text
+// continuation to llama.cpp's /completion endpoint. Unlike the chat endpoint
+// there is no chat template, and the server's sampler and grammar options can
+// be set from the AI: line.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// llamaCppOptions are the AI: line options of llama.cpp endpoints, sent as
+// /completion request fields. grammar names a file whose contents are sent.
+var llamaCppOptions = map[string]optionSpec{
+	"stream":            {"stream", optionBool},
+	"grammar":           {"grammar", optionString},
+	"id_slot":           {"id_slot", optionInt},
+	"seed":              {"seed", optionInt},
+	"top_k":             {"top_k", optionInt},
+	"top_p":             {"top_p", optionFloat},
+	"min_p":             {"min_p", optionFloat},
+	"typical_p":         {"typical_p", optionFloat},
+	"repeat_last_n":     {"repeat_last_n", optionInt},
+	"repeat_penalty":    {"repeat_penalty", optionFloat},
+	"presence_penalty":  {"presence_penalty", optionFloat},
+	"frequency_penalty": {"frequency_penalty", optionFloat},
+	"mirostat":          {"mirostat", optionInt},
+	"mirostat_tau":      {"mirostat_tau", optionFloat},
+	"mirostat_eta":      {"mirostat_eta", optionFloat},
+	"n_probs":           {"n_probs", optionInt},
+	"n_keep":            {"n_keep", optionInt},
+	"stop":              {"stop", optionList},
+}
+
+// llamaCppResponse is a /completion response or one event of a streamed one.
+type llamaCppResponse struct {
+	Content         string `json:"content"`
+	Stop            bool   `json:"stop"`
+	TokensEvaluated int    `json:"tokens_evaluated"`
+	TokensPredicted int    `json:"tokens_predicted"`
+	Timings         *struct {
+		PromptN int `json:"prompt_n"` // prompt tokens not found in the cache
+	} `json:"timings"`
+}
+
+// cachedTokens returns the number of prompt tokens the server took from its
+// cache, or -1 if it didn't report timings.
+func (r llamaCppResponse) cachedTokens() int {
+	if r.Timings == nil {
+		return -1
+	}
+	return r.TokensEvaluated - r.Timings.PromptN
+}
+
+// llamaCppCompleter sends requests to a llama.cpp server's /completion
+// endpoint. The endpoint returns one response per request, so n completions
+// take n requests. Requests for a document go to its own slot unless the
+// id_slot option is set.
+type llamaCppCompleter struct{}
+
+func (llamaCppCompleter) Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error) {
+	var result completion
+	body, stream, err := llamaCppRequestFor(req.Prompt, req.MaxTokens, ep.temperature(req), req.Options)
+	if err != nil {
+		return result, err
+	}
+	if _, ok := body["grammar"]; !ok && req.Schema != nil {
+		// A grammar option takes precedence over the schema's grammar.
+		if body["grammar"], err = schemaGrammar(req.Schema); err != nil {
+			return result, err
+		}
+	}
+	slot, ok := body["id_slot"].(int)
+	if !ok {
+		slot = slotFor(ep, req.Doc)
+		body["id_slot"] = slot
+	}
+	headers := make(map[string]string)
+	key, err := ep.apiKey()
+	if err != nil {
+		return result, err
+	}
+	if key != "" {
+		headers["Authorization"] = "Bearer " + key // llama-server --api-key
+	}
+	url := strings.TrimSuffix(ep.URL, "/") + "/completion"
+	for i := 0; i < req.N; i++ {
+		var r llamaCppResponse
+		err = withRetries(ctx, func(ctx context.Context) error {
+			var err error
+			r, err = llamaCppPost(ctx, url, headers, body, stream)
+			return err
+		})
+		if err != nil {
+			return completion{}, err
+		}
+		logCacheUse(ep, slot, r.TokensEvaluated, r.cachedTokens())
+		result.Choices = append(result.Choices, r.Content)
+		result.PromptTokens += r.TokensEvaluated
+		result.CompletionTokens += r.TokensPredicted
+	}
+	log.Printf("tokens: prompt=%d, completion=%d, total=%d\n", result.PromptTokens, result.CompletionTokens, result.PromptTokens+result.CompletionTokens)
+	return result, nil
+}
+
+// llamaCppRequestFor builds the /completion request body for the AI: line
+// options and reports whether the response will be streamed. The grammar
+// option names a GBNF file whose contents are sent.
+func llamaCppRequestFor(prompt string, maxTokens int, temperature float64, opts map[string]string) (map[string]interface{}, bool, error) {
+	body := map[string]interface{}{
+		"prompt":       prompt,
+		"n_predict":    maxTokens,
+		"temperature":  temperature,
+		"cache_prompt": true,
+	}
+	stream := false
+	for k, v := range opts {
+		spec, err := lookupOption(providerLlamaCpp, llamaCppOptions, k)
+		if err != nil {
+			return nil, false, err
+		}
+		value, err := spec.value(v)
+		switch k {
+		case "stream":
+			stream = err == nil && value.(bool)
+		case "grammar":
+			var g []byte
+			g, err = os.ReadFile(v)
+			body[spec.field] = string(g)
+		default:
+			body[spec.field] = value
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("option %s=%s: %w", k, v, err)
+		}
+	}
+	body["stream"] = stream
+	return body, stream, nil
+}
+
+// llamaCppPost sends body and returns the response. A streamed response
+// arrives as server-sent events, which are assembled into one.
+func llamaCppPost(ctx context.Context, url string, headers map[string]string, body map[string]interface{}, stream bool) (llamaCppResponse, error) {
+	var r llamaCppResponse
+	resp, err := postJSON(ctx, url, headers, body)
+	if err != nil {
+		return r, err
+	}
+	defer resp.Body.Close()
+	if !stream {
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		return r, err
+	}
+	var text strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event llamaCppResponse
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return r, err
+		}
+		text.WriteString(event.Content)
+		if event.Stop {
+			r = event
+			r.Content = text.String()
+			return r, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return r, err
+	}
+	return r, errors.New("llama.cpp: response ended early")
+}
+
+// fileOptions are the options that name files.
+var fileOptions = []string{"grammar", "system"}
+
+// resolveOptionPaths returns a copy of opts in which fileOptions are relative
+// to the document's directory dir rather than ficta's working directory.
+func resolveOptionPaths(opts map[string]string, dir string) map[string]string {
+	resolved := make(map[string]string, len(opts))
+	for k, v := range opts {
+		if contains(fileOptions, k) && v != "" {
+			v = expandHome(v)
+			if !filepath.IsAbs(v) && dir != "" {
+				v = filepath.Join(dir, v)
+			}
+		}
+		resolved[k] = v
+	}
+	return resolved
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendLlamaCpp(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/completion" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		if body["stream"] == true {
+			for _, word := range []string{"The", " fox", " ran."} {
+				fmt.Fprintf(w, "data: {\"content\": %q, \"stop\": false}\n\n", word)
+			}
+			fmt.Fprint(w, "data: {\"content\": \"\", \"stop\": true, \"tokens_evaluated\": 12, \"tokens_predicted\": 4}\n\n")
+			return
+		}
+		fmt.Fprint(w, `{"content": "The fox ran.", "stop": true, "tokens_evaluated": 12, "tokens_predicted": 4, "timings": {"prompt_n": 2}}`)
+	}))
+	defer server.Close()
+	ep := &endpoint{Name: "llamacpp", URL: server.URL + "/", Provider: providerLlamaCpp}
+
+	for _, stream := range []string{"false", "true"} {
+		bodies = nil
+		req := completionRequest{Doc: "story.txt", Prompt: "Once upon a time", MaxTokens: 64, Temperature: 0.5, N: 2, Options: map[string]string{"stream": stream}}
+		c, err := llamaCppCompleter{}.Complete(context.Background(), ep, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Choices) != 2 || c.Choices[1] != "The fox ran." || c.PromptTokens != 24 || c.CompletionTokens != 8 {
+			t.Errorf("stream=%s: unexpected result %+v", stream, c)
+		}
+		if bodies[0]["prompt"] != "Once upon a time" || bodies[0]["n_predict"] != float64(64) || bodies[0]["cache_prompt"] != true || bodies[0]["id_slot"] != float64(0) {
+			t.Errorf("stream=%s: unexpected request %v", stream, bodies[0])
+		}
+	}
+}
+
+func TestLlamaCppRequestFor(t *testing.T) {
+	dir := t.TempDir()
+	grammar := `root ::= "yes" | "no"`
+	os.WriteFile(filepath.Join(dir, "yesno.gbnf"), []byte(grammar), 0644)
+	opts := resolveOptionPaths(map[string]string{
+		"min_p":    "0.05",
+		"top_k":    "40",
+		"mirostat": "2",
+		"grammar":  "yesno.gbnf",
+		"n_probs":  "3",
+		"stop":     "CHAPTER|THE END",
+	}, dir)
+	body, stream, err := llamaCppRequestFor("Answer:", 10, 0.3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream || body["min_p"] != 0.05 || body["top_k"] != 40 || body["mirostat"] != 2 || body["n_probs"] != 3 {
+		t.Errorf("Unexpected body %v", body)
+	}
+	if body["grammar"] != grammar {
+		t.Errorf("Expected the grammar file contents, got %v", body["grammar"])
+	}
+	if stop, _ := body["stop"].([]string); len(stop) != 2 || stop[0] != "CHAPTER" || stop[1] != "THE END" {
+		t.Errorf("Expected two stop sequences, got %#v", body["stop"])
+	}
+
+	_, _, err = llamaCppRequestFor("Answer:", 10, 0.3, map[string]string{"top_k": "many"})
+	if err == nil || !strings.Contains(err.Error(), "top_k=many") {
+		t.Errorf("Expected an option error, got %v", err)
+	}
+	_, _, err = llamaCppRequestFor("Answer:", 10, 0.3, map[string]string{"seeed": "3"})
+	if err == nil || !strings.Contains(err.Error(), "option seeed: not an option of llamacpp endpoints") {
+		t.Errorf("Expected an unknown option error, got %v", err)
+	}
+	_, _, err = llamaCppRequestFor("Answer:", 10, 0.3, resolveOptionPaths(map[string]string{"grammar": "missing.gbnf"}, dir))
+	if err == nil {
+		t.Errorf("Expected an error for a missing grammar file")
+	}
+}
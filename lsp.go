@@ -0,0 +1,614 @@
+package main
+
+// This file implements "ficta lsp", a small Language Server Protocol server for
+// ficta documents. It speaks JSON-RPC 2.0 on stdin/stdout using the
+// Content-Length framing defined by the LSP specification and keeps the text
+// of open documents in memory, so diagnostics and completions reflect unsaved
+// edits.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// knownModels are offered as completions for the model field of an AI: line.
+var knownModels = []string{
+	"gpt-3.5-turbo",
+	"gpt-4",
+	"gpt-4-turbo",
+	"gpt-4o",
+	"gpt-4o-mini",
+	"url",
+	"ollama:llama3",
+	"llamacpp",
+	"anthropic:claude-3-5-sonnet-latest",
+	"anthropic:claude-3-5-haiku-latest",
+	"gemini:gemini-1.5-pro",
+	"gemini:gemini-1.5-flash",
+}
+
+// aiOptionKeys are offered as completions after the positional fields of an
+// AI: line, with a short description.
+var aiOptionKeys = map[string]string{
+	"num_ctx":        "Ollama: context window size in tokens",
+	"keep_alive":     "Ollama: how long the model stays loaded, e.g. 30m",
+	"mode":           "Ollama: chat or generate",
+	"raw":            "Ollama: true sends the prompt without the model's template",
+	"stream":         "Ollama, llama.cpp, Anthropic, Gemini: true streams the response",
+	"seed":           "OpenAI, Ollama, llama.cpp, Gemini: random seed for repeatable responses",
+	"min_p":          "llama.cpp: minimum probability relative to the most likely token",
+	"top_k":          "Ollama, llama.cpp, Anthropic, Gemini: sample from the k most likely tokens",
+	"top_p":          "nucleus sampling probability",
+	"stop":           "stop sequences, separated by '|'",
+	"repeat_penalty": "Ollama, llama.cpp: penalty for repeated tokens, e.g. 1.1",
+	"mirostat":       "llama.cpp: 0 off, 1 Mirostat, 2 Mirostat 2.0",
+	"mirostat_tau":   "llama.cpp: Mirostat target entropy",
+	"mirostat_eta":   "llama.cpp: Mirostat learning rate",
+	"grammar":        "llama.cpp: GBNF grammar file, relative to the document",
+	"system":         "system prompt file, relative to the document",
+	"raw_temp":       "temperature sent as it is, in the model's own range",
+	"cache":          "response cache: auto, on or off",
+}
+
+// completeNowCommand identifies the "complete now" code action.
+const completeNowCommand = "ficta.completeNow"
+
+// LSP constants used below. See the LSP specification for the full sets.
+const (
+	lspSeverityError      = 1
+	lspSeverityWarning    = 2
+	lspCompletionProperty = 10
+	lspCompletionValue    = 12
+	lspCompletionSnippet  = 15
+	lspTextSyncFull       = 1
+	lspMethodNotFound     = -32601
+	lspInvalidParams      = -32602
+	lspMessageError       = 1
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCompletionItem struct {
+	Label      string       `json:"label"`
+	Kind       int          `json:"kind"`
+	Detail     string       `json:"detail,omitempty"`
+	InsertText string       `json:"insertText,omitempty"`
+	TextEdit   *lspTextEdit `json:"textEdit,omitempty"`
+}
+
+type lspCommand struct {
+	Title     string        `json:"title"`
+	Command   string        `json:"command"`
+	Arguments []interface{} `json:"arguments,omitempty"`
+}
+
+// lspMessage is an incoming request, notification or response.
+type lspMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// lspDocumentParams covers the parameters of every textDocument method the
+// server handles. Each method only looks at the fields it needs.
+type lspDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	Position       lspPosition `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+// lspServer holds the state of one LSP session.
+type lspServer struct {
+	in  *bufio.Reader
+	out io.Writer
+	wmu sync.Mutex // serializes writes to out
+
+	mu     sync.Mutex        // guards docs and nextID
+	docs   map[string]string // open documents by URI
+	nextID int               // id of the next request we send to the client
+
+	// complete runs a completion on the text of the document at uri. It is a
+	// field so tests can replace it.
+	complete func(uri, text string) (string, error)
+}
+
+// runLSP serves the Language Server Protocol on stdin and stdout until the
+// client sends "exit" or closes stdin.
+func runLSP(args []string) error {
+	s := newLSPServer(os.Stdin, os.Stdout)
+	return s.serve()
+}
+
+func newLSPServer(in io.Reader, out io.Writer) *lspServer {
+	return &lspServer{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]string),
+		complete: func(uri, text string) (string, error) {
+			response, _, err := completeText(text, uriPath(uri))
+			return response, err
+		},
+	}
+}
+
+// serve reads and dispatches messages until exit or end of input.
+func (s *lspServer) serve() error {
+	for {
+		data, err := readLSPMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg lspMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Println("lsp: bad message:", err)
+			continue
+		}
+		switch msg.Method {
+		case "":
+			// A response to one of our requests, e.g. workspace/applyEdit.
+			continue
+		case "exit":
+			return nil
+		}
+		if err := s.handle(&msg); err != nil {
+			log.Println("lsp:", err)
+		}
+	}
+}
+
+// handle dispatches a single request or notification.
+func (s *lspServer) handle(msg *lspMessage) error {
+	var p lspDocumentParams
+	if len(msg.Params) > 0 && msg.Method != "workspace/executeCommand" {
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return s.replyError(msg.ID, lspInvalidParams, err.Error())
+		}
+	}
+	uri := p.TextDocument.URI
+	switch msg.Method {
+	case "initialize":
+		return s.reply(msg.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   lspTextSyncFull,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{":"}},
+				"hoverProvider":      true,
+				"codeActionProvider": true,
+				"executeCommandProvider": map[string]interface{}{
+					"commands": []string{completeNowCommand},
+				},
+			},
+			"serverInfo": map[string]string{"name": "ficta"},
+		})
+	case "initialized":
+		return nil
+	case "shutdown":
+		return s.reply(msg.ID, nil)
+	case "textDocument/didOpen":
+		s.setDoc(uri, p.TextDocument.Text)
+		return s.publishDiagnostics(uri, p.TextDocument.Text)
+	case "textDocument/didChange":
+		// We ask for full document sync, so the last change holds the whole text.
+		if n := len(p.ContentChanges); n > 0 {
+			text := p.ContentChanges[n-1].Text
+			s.setDoc(uri, text)
+			return s.publishDiagnostics(uri, text)
+		}
+		return nil
+	case "textDocument/didClose":
+		s.mu.Lock()
+		delete(s.docs, uri)
+		s.mu.Unlock()
+		return s.publishDiagnostics(uri, "")
+	case "textDocument/completion":
+		text, _ := s.doc(uri)
+		return s.reply(msg.ID, completionItems(text, p.Position))
+	case "textDocument/hover":
+		text, _ := s.doc(uri)
+		return s.reply(msg.ID, map[string]interface{}{
+			"contents": map[string]string{"kind": "markdown", "value": hoverText(text, uriPath(uri))},
+		})
+	case "textDocument/codeAction":
+		return s.reply(msg.ID, []interface{}{
+			map[string]interface{}{
+				"title":   "ficta: complete now",
+				"kind":    "source",
+				"command": lspCommand{Title: "Complete now", Command: completeNowCommand, Arguments: []interface{}{uri}},
+			},
+		})
+	case "workspace/executeCommand":
+		return s.executeCommand(msg)
+	}
+	if len(msg.ID) > 0 {
+		return s.replyError(msg.ID, lspMethodNotFound, "method not supported: "+msg.Method)
+	}
+	return nil // ignore unknown notifications
+}
+
+// executeCommand handles the "complete now" command. The completion runs in
+// the background and its result is applied with a workspace/applyEdit request
+// so the editor stays responsive while the endpoint works.
+func (s *lspServer) executeCommand(msg *lspMessage) error {
+	var p struct {
+		Command   string            `json:"command"`
+		Arguments []json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return s.replyError(msg.ID, lspInvalidParams, err.Error())
+	}
+	if p.Command != completeNowCommand || len(p.Arguments) != 1 {
+		return s.replyError(msg.ID, lspInvalidParams, "unknown command: "+p.Command)
+	}
+	var uri string
+	if err := json.Unmarshal(p.Arguments[0], &uri); err != nil {
+		return s.replyError(msg.ID, lspInvalidParams, err.Error())
+	}
+	text, ok := s.doc(uri)
+	if !ok {
+		return s.replyError(msg.ID, lspInvalidParams, "document is not open: "+uri)
+	}
+	if err := s.reply(msg.ID, nil); err != nil {
+		return err
+	}
+	go func() {
+		newText, err := s.complete(uri, text)
+		if err != nil {
+			s.notify("window/showMessage", map[string]interface{}{
+				"type":    lspMessageError,
+				"message": "ficta: " + err.Error(),
+			})
+			return
+		}
+		// The buffer may have changed while the endpoint worked.
+		current, _ := s.doc(uri)
+		edit := map[string]interface{}{
+			"label": "ficta: complete now",
+			"edit": map[string]interface{}{
+				"changes": map[string][]lspTextEdit{
+					uri: {completionEdit(text, newText, current)},
+				},
+			},
+		}
+		if err := s.request("workspace/applyEdit", edit); err != nil {
+			log.Println("lsp:", err)
+		}
+	}()
+	return nil
+}
+
+func (s *lspServer) setDoc(uri, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[uri] = text
+}
+
+func (s *lspServer) doc(uri string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text, ok := s.docs[uri]
+	return text, ok
+}
+
+func (s *lspServer) publishDiagnostics(uri, text string) error {
+	return s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": append(diagnoseAILines(text), diagnoseComments(text, uriPath(uri))...),
+	})
+}
+
+func (s *lspServer) reply(id json.RawMessage, result interface{}) error {
+	return s.send(map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func (s *lspServer) replyError(id json.RawMessage, code int, message string) error {
+	return s.send(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"error":   map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	return s.send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// request sends a request to the client. Responses are ignored by serve.
+func (s *lspServer) request(method string, params interface{}) error {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+	return s.send(map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+}
+
+func (s *lspServer) send(msg interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return writeLSPMessage(s.out, msg)
+}
+
+// readLSPMessage reads one Content-Length framed message body from r.
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length header: %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+// writeLSPMessage writes msg to w as a Content-Length framed JSON body.
+func writeLSPMessage(w io.Writer, msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// diagnoseAILines reports an error if the AI: line that ficta would use for
+// the next request can't be parsed. Earlier AI: lines are ordinary prompt text
+// and are not checked.
+func diagnoseAILines(text string) []lspDiagnostic {
+	diags := []lspDiagnostic{}
+	part1, aiLine := findLastAILine(text)
+	if aiLine == "" {
+		return diags
+	}
+	if _, _, _, _, err := parseAILine(aiLine); err != nil {
+		lineNo := strings.Count(part1, "\n")
+		line := strings.Split(text, "\n")[lineNo]
+		start := utf16Len(line[:strings.Index(line, "AI:")])
+		diags = append(diags, lspDiagnostic{
+			Range: lspRange{
+				Start: lspPosition{Line: lineNo, Character: start},
+				End:   lspPosition{Line: lineNo, Character: utf16Len(strings.TrimRight(line, " \t\r"))},
+			},
+			Severity: lspSeverityError,
+			Source:   "ficta",
+			Message:  err.Error() + "; ficta will use its default model parameters",
+		})
+	}
+	return diags
+}
+
+// diagnoseComments warns of an unterminated block comment and of block
+// comment suffixes outside a block comment in the document filename, and of
+// a modeline naming an unknown comment profile.
+func diagnoseComments(text, filename string) []lspDiagnostic {
+	diags := []lspDiagnostic{}
+	syn, err := commentSyntaxFor(filename, text)
+	if err != nil {
+		diags = append(diags, lspDiagnostic{
+			Range:    lspRange{End: lspPosition{Character: utf16Len(strings.SplitN(text, "\n", 2)[0])}},
+			Severity: lspSeverityError,
+			Source:   "ficta",
+			Message:  err.Error(),
+		})
+	}
+	_, warnings := stripComments(text, syn)
+	lines := strings.Split(text, "\n")
+	for _, w := range warnings {
+		line := lines[w.Line-1]
+		diags = append(diags, lspDiagnostic{
+			Range: lspRange{
+				Start: lspPosition{Line: w.Line - 1},
+				End:   lspPosition{Line: w.Line - 1, Character: utf16Len(strings.TrimRight(line, " \t\r"))},
+			},
+			Severity: lspSeverityWarning,
+			Source:   "ficta",
+			Message:  w.Message,
+		})
+	}
+	return diags
+}
+
+// completionItems returns the completions for the cursor at pos. In the model
+// field of an AI: line it offers model names, after the positional fields it
+// offers option keys and at the start of an empty line it offers a complete
+// AI: line.
+func completionItems(text string, pos lspPosition) []lspCompletionItem {
+	items := []lspCompletionItem{}
+	lines := strings.Split(text, "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return items
+	}
+	line := strings.TrimRight(lines[pos.Line], "\r")
+	prefix := line[:utf16ToByteOffset(line, pos.Character)]
+	trimmed := strings.TrimLeft(prefix, " \t")
+	switch {
+	case strings.HasPrefix(trimmed, "AI:") && !strings.Contains(trimmed, ","):
+		// Replace whatever model text precedes the cursor.
+		start := strings.Index(prefix, "AI:") + len("AI:")
+		for start < len(prefix) && (prefix[start] == ' ' || prefix[start] == '\t') {
+			start++
+		}
+		r := lspRange{
+			Start: lspPosition{Line: pos.Line, Character: utf16Len(prefix[:start])},
+			End:   pos,
+		}
+		for _, m := range knownModels {
+			items = append(items, lspCompletionItem{
+				Label:    m,
+				Kind:     lspCompletionValue,
+				Detail:   "model",
+				TextEdit: &lspTextEdit{Range: r, NewText: m},
+			})
+		}
+	case strings.HasPrefix(trimmed, "AI:") && strings.Count(trimmed, ",") >= 3:
+		// After the four positional fields, offer option keys unless the
+		// cursor is already in a value. At the end of the fourth field the
+		// key comes with the comma that separates it.
+		fields := strings.Split(trimmed, ",")
+		field, before := fields[len(fields)-1], fields[:len(fields)-1]
+		sep := ""
+		switch {
+		case len(before) >= 4 && positionalFields(before) >= 4 && !strings.Contains(field, "="):
+		case len(fields) == 4 && positionalFields(fields) == 4 && strings.TrimSpace(field) != "":
+			sep = ", "
+		default:
+			return items
+		}
+		keys := make([]string, 0, len(aiOptionKeys))
+		for k := range aiOptionKeys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			items = append(items, lspCompletionItem{
+				Label:      k,
+				Kind:       lspCompletionProperty,
+				Detail:     aiOptionKeys[k],
+				InsertText: sep + k + "=",
+			})
+		}
+	case strings.HasPrefix("AI:", trimmed):
+		items = append(items, lspCompletionItem{
+			Label:      "AI:",
+			Kind:       lspCompletionSnippet,
+			Detail:     "model, max tokens, temperature, responses",
+			InsertText: "AI: gpt-3.5-turbo, 100, 0.700, 1",
+		})
+	}
+	return items
+}
+
+// hoverText describes the request that saving the document would send.
+func hoverText(text, filename string) string {
+	part1, aiLine := findLastAILine(text)
+	syn, _ := commentSyntaxFor(filename, text)
+	prompt, _ := stripComments(removeModeline(part1), syn)
+	model, maxTokens, temperature, n, err := parseAILine(aiLine)
+	var b strings.Builder
+	fmt.Fprintf(&b, "**ficta** prompt: ~%d tokens (%d words)\n\n", estimateTokens(prompt), len(strings.Fields(prompt)))
+	fmt.Fprintf(&b, "next request: `%s`, %d max tokens, temperature %0.3f, %d response(s)", model, maxTokens, temperature, n)
+	if err != nil {
+		fmt.Fprintf(&b, "\n\nAI: line error: %v", err)
+	}
+	return b.String()
+}
+
+// completionEdit returns the edit that applies newText, the completion of
+// the snapshot text, to the document as it is now, current. Only the end of
+// text that the completion changed, normally the old AI: line, is replaced,
+// where it is found in current, so what was typed during the request is
+// kept. If it was edited too, the new end is inserted at the end of current.
+func completionEdit(text, newText, current string) lspTextEdit {
+	i := 0
+	for i < len(text) && i < len(newText) && text[i] == newText[i] {
+		i++
+	}
+	for i > 0 && i < len(text) && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	oldEnd, newEnd := text[i:], newText[i:]
+	if j := strings.LastIndex(current, oldEnd); oldEnd != "" && j >= 0 {
+		return lspTextEdit{Range: lspRange{Start: offsetPosition(current, j), End: offsetPosition(current, j+len(oldEnd))}, NewText: newEnd}
+	}
+	end := documentRange(current).End
+	if current != "" && !strings.HasSuffix(current, "\n") {
+		newEnd = "\n\n" + newEnd
+	}
+	return lspTextEdit{Range: lspRange{Start: end, End: end}, NewText: newEnd}
+}
+
+// offsetPosition returns the position of the byte offset i in text.
+func offsetPosition(text string, i int) lspPosition {
+	before := text[:i]
+	start := strings.LastIndex(before, "\n") + 1
+	return lspPosition{Line: strings.Count(before, "\n"), Character: utf16Len(before[start:])}
+}
+
+// documentRange returns the range that spans all of text.
+func documentRange(text string) lspRange {
+	lines := strings.Split(text, "\n")
+	last := len(lines) - 1
+	return lspRange{End: lspPosition{Line: last, Character: utf16Len(lines[last])}}
+}
+
+// uriPath returns the file system path of a file: URI, or "" for other URIs.
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+// utf16Len returns the length of s in UTF-16 code units, the unit LSP uses
+// for character offsets.
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// utf16ToByteOffset converts a UTF-16 character offset within line to a byte
+// offset, clamping at the end of the line.
+func utf16ToByteOffset(line string, char int) int {
+	n := 0
+	for i, r := range line {
+		if n >= char {
+			return i
+		}
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
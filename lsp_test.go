@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDiagnoseAILines(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected int
+		line     int
+	}{
+		{name: "No AI line", text: "Once upon a time", expected: 0},
+		{name: "Valid AI line", text: "Once upon a time\n\nAI: gpt-4, 100, 0.7, 1", expected: 0},
+		{name: "Bad temperature", text: "Once upon a time\n\nAI: gpt-4, 100, 1.7, 1", expected: 1, line: 2},
+		{name: "Only last line checked", text: "AI: bad\nOnce upon a time\n  AI: gpt-4, 100, 0.7", expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diags := diagnoseAILines(tt.text)
+			if len(diags) != tt.expected {
+				t.Fatalf("Expected %d diagnostics, got %v", tt.expected, diags)
+			}
+			if tt.expected > 0 && diags[0].Range.Start.Line != tt.line {
+				t.Errorf("Expected diagnostic on line %d, got %d", tt.line, diags[0].Range.Start.Line)
+			}
+		})
+	}
+}
+
+func TestCompletionItems(t *testing.T) {
+	text := "Some text\nAI: gp\n"
+	items := completionItems(text, lspPosition{Line: 1, Character: 6})
+	if len(items) != len(knownModels) {
+		t.Fatalf("Expected %d model completions, got %d", len(knownModels), len(items))
+	}
+	if r := items[0].TextEdit.Range; r.Start.Character != 4 || r.End.Character != 6 {
+		t.Errorf("Unexpected edit range %+v", r)
+	}
+	items = completionItems("AI: ollama:llama3, 100, 0.7, 1, n", lspPosition{Line: 0, Character: 34})
+	if len(items) != len(aiOptionKeys) || !sort.SliceIsSorted(items, func(i, j int) bool { return items[i].Label < items[j].Label }) {
+		t.Errorf("Expected sorted option keys, got %v", items)
+	}
+	items = completionItems("AI: gpt-4, 100, 0.7, 2", lspPosition{Line: 0, Character: 22})
+	if len(items) != len(aiOptionKeys) || items[0].InsertText != ", "+items[0].Label+"=" {
+		t.Errorf("Expected option keys after the fourth field, got %v", items)
+	}
+	items = completionItems("AI: gpt-4, 100, 0.7, 2, seed=", lspPosition{Line: 0, Character: 29})
+	if len(items) != 0 {
+		t.Errorf("Expected no completions in a value, got %v", items)
+	}
+	items = completionItems("AI: gpt-4, 100, 0.7, ", lspPosition{Line: 0, Character: 21})
+	if len(items) != 0 {
+		t.Errorf("Expected no completions before the fourth field, got %v", items)
+	}
+	items = completionItems(text, lspPosition{Line: 2, Character: 0})
+	if len(items) != 1 || items[0].Label != "AI:" {
+		t.Errorf("Expected an AI: snippet, got %v", items)
+	}
+}
+
+func TestCompletionEdit(t *testing.T) {
+	text := "Once upon a time.\n\nAI: gpt-4, 100, 0.7, 1"
+	newText := "Once upon a time.\n\nIt was dark.\n\nAI: gpt-4, 100, 0.700, 1"
+	tests := []struct {
+		name     string
+		current  string
+		expected lspTextEdit
+	}{
+		{
+			name:     "Unchanged",
+			current:  text,
+			expected: lspTextEdit{Range: lspRange{Start: lspPosition{Line: 2}, End: lspPosition{Line: 2, Character: 22}}, NewText: "It was dark.\n\nAI: gpt-4, 100, 0.700, 1"},
+		},
+		{
+			name:     "Typed above",
+			current:  "Title\n" + text,
+			expected: lspTextEdit{Range: lspRange{Start: lspPosition{Line: 3}, End: lspPosition{Line: 3, Character: 22}}, NewText: "It was dark.\n\nAI: gpt-4, 100, 0.700, 1"},
+		},
+		{
+			name:     "AI: line edited",
+			current:  "Once upon a time.\n\nAI: gpt-4o, 100, 0.7, 1",
+			expected: lspTextEdit{Range: lspRange{Start: lspPosition{Line: 2, Character: 23}, End: lspPosition{Line: 2, Character: 23}}, NewText: "\n\nIt was dark.\n\nAI: gpt-4, 100, 0.700, 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := completionEdit(text, newText, tt.current); got != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// lspClient drives an lspServer over pipes the way an editor would.
+type lspClient struct {
+	t   *testing.T
+	w   io.Writer
+	r   *bufio.Reader
+	seq int
+}
+
+func (c *lspClient) send(method string, params interface{}, isRequest bool) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if isRequest {
+		c.seq++
+		msg["id"] = c.seq
+	}
+	if err := writeLSPMessage(c.w, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lspClient) receive() map[string]interface{} {
+	body, err := readLSPMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+func TestLSPSession(t *testing.T) {
+	clientToServer, serverIn := io.Pipe()
+	serverOut, clientFromServer := io.Pipe()
+	s := newLSPServer(clientToServer, clientFromServer)
+	s.complete = func(uri, text string) (string, error) {
+		return text + "\nThe end.", nil
+	}
+	done := make(chan error)
+	go func() { done <- s.serve() }()
+	c := &lspClient{t: t, w: serverIn, r: bufio.NewReader(serverOut)}
+
+	c.send("initialize", map[string]interface{}{}, true)
+	if msg := c.receive(); msg["result"] == nil {
+		t.Fatalf("Expected initialize result, got %v", msg)
+	}
+
+	uri := "file:///tmp/story.ait"
+	c.send("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri, "text": "Once\nAI: gpt-4, x, 0.7"},
+	}, false)
+	msg := c.receive()
+	if msg["method"] != "textDocument/publishDiagnostics" {
+		t.Fatalf("Expected diagnostics, got %v", msg)
+	}
+	if diags := msg["params"].(map[string]interface{})["diagnostics"].([]interface{}); len(diags) != 1 {
+		t.Errorf("Expected 1 diagnostic, got %v", diags)
+	}
+
+	c.send("workspace/executeCommand", map[string]interface{}{
+		"command":   completeNowCommand,
+		"arguments": []string{uri},
+	}, true)
+	if msg := c.receive(); msg["error"] != nil {
+		t.Fatalf("executeCommand failed: %v", msg)
+	}
+	msg = c.receive()
+	if msg["method"] != "workspace/applyEdit" {
+		t.Fatalf("Expected applyEdit, got %v", msg)
+	}
+	raw, _ := json.Marshal(msg["params"])
+	if !bytes.Contains(raw, []byte("The end.")) {
+		t.Errorf("Expected the completion in the edit, got %s", raw)
+	}
+
+	c.send("exit", nil, false)
+	if err := <-done; err != nil {
+		t.Errorf("serve returned %v", err)
+	}
+}
+
+func TestReadLSPMessage(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("Content-Length: 2\r\nContent-Type: x\r\n\r\n{}"))
+	body, err := readLSPMessage(r)
+	if err != nil || string(body) != "{}" {
+		t.Errorf("Expected {}, got %q, %v", body, err)
+	}
+	r = bufio.NewReader(strings.NewReader("\r\n{}"))
+	if _, err := readLSPMessage(r); err == nil {
+		t.Errorf("Expected an error for a missing Content-Length")
+	}
+}
@@ -5,18 +5,18 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/Michael-F-Ellis/goopenai"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -26,10 +26,18 @@ const USAGE = `
 FICTA v1.3.2
 
 Usage: ficta [options] file1 [file2 ...]
+       ficta [options] lsp
+       ficta [options] cache stats|clear
+       ficta [options] compare file model [model ...]
+       ficta [options] provenance file [file ...]
+       ficta [options] export output file|dir [file|dir ...]
+       ficta [options] stats [-json] file|dir [file|dir ...]
+       ficta [options] new [-t template] file [file ...]
+       ficta [options] check file|dir [file|dir ...]
 
 ficta monitors one or more files for changes and sends a request to a completion
 endpoint with the text of the file. If you pass a filename that doesn't exist,
-ficta will create it and write some default content to it.
+ficta will create it from a template (see the new command).
 
 Options:
    -h Show this help message.
@@ -37,10 +45,48 @@ Options:
    -b backup extension: the extension for backup files. If -b is not specified,
       ficta will not create backup files when a file is updated.
    -u URL endpoint: the URL for non-OpenAI completion requests.
+   -f config file: a JSON file declaring named endpoints and their credentials.
+      Default is ficta/config.json in your user configuration directory.
    -c line comment prefix: the prefix string for comment lines. Default is '//'.
    -y block comment prefix, default = '/*'
    -z block comment suffix, default = '*/'
-   Commented lines are excluded from text sent to the OpenAI completion endpoint.
+   -nb nested block comments: /* a /* b */ c */ is one comment.
+   Comments are excluded from text sent to the completion endpoint. A line
+   comment starts at the beginning of a line or after a space; a block comment
+   may start and end anywhere. Write \// or \/* to send the characters.
+   Files ending in .md, .markdown, .html and .htm use <!-- --> comments, .tex
+   uses % and .org uses # and #+BEGIN_COMMENT unless -c, -y or -z is given.
+   A first line such as "// ficta: comments=html" selects the comments of any
+   file: c, html, latex or org.
+   -r retries: the number of times a request that failed with a rate limit,
+      server error, timeout or network error is retried. Default is 2.
+   -t timeout: the time limit for each attempt, default = 2m
+   If the last attempt fails, ficta inserts a line comment describing the
+   error just above the AI: line.
+   -fb fallback models: models, separated by '|', to try in order when those
+      on the AI: line fail. See "Fallback chains" below.
+   -fs status codes: the HTTP status codes that make ficta try the next model,
+      default = '404,429,500,502,503,504'. Network errors always do.
+   -J journal name: each request is logged to a file with this name in the
+      document's directory, default = '.ficta-journal.jsonl'. -J '' disables it.
+   -pre command: a pre-hook. The cleaned prompt is piped through the command and
+      its output is sent instead.
+   -post command: a post-hook. Each response is piped through the command and
+      its output is inserted instead, e.g. -post 'fmt -w 80'.
+   -ht hook timeout, default = 30s
+   -hf hook failure policy: 'skip' (default) logs the failure and uses the
+      unmodified text; 'abort' logs it and leaves the file untouched.
+   -s slots: the number of slots of each llama.cpp server, default = 1. Each
+      document gets a slot of its own so the server can reuse its cached
+      prompt; start llama-server with the same number, e.g. -np 4.
+   -cache mode: 'auto' (default) answers a request that was made before from
+      the response cache if its temperature is 0 or it sets a seed; 'on'
+      caches every request and 'off' none. The cache option of the AI: line
+      overrides it, e.g. cache=on.
+   -cd cache directory, default is ficta in your user cache directory.
+   -pv mode: 'comment' writes each response between comments naming the model
+      and the time, 'invisible' between invisible Unicode characters carrying
+      the same; the default is 'off'.
 
 When you save a changed file, ficta will call the completion endpoint and
 overwrites the file with the original text followed by the completion response,
@@ -56,9 +102,16 @@ temperature, and N; those values will be used for the next completion request.
 See the openai.com API documentation to learn more about models, max tokens and
 temperature, and N.
 
-You need a valid OpenAI API key and Organization ID to use ficta.  Ficta
-expects to find them in environment variables named OPENAI_API_KEY and 
-OPENAI_API_ORG.
+The temperature is between 0 and 1 and is scaled to the range of the model's
+provider: 0 to 2 for OpenAI and Gemini, 0 to 1 for Anthropic, Ollama and
+llama.cpp. An endpoint can declare its own "temperature_range" in the config
+file. To send a temperature unchanged, add raw_temp, e.g.
+
+   AI: gpt-4o, 100, 0.700, 1, raw_temp=1.15
+
+To use OpenAI models you need a valid OpenAI API key. Ficta expects to find it
+in the environment variable OPENAI_API_KEY, and an optional Organization ID in
+OPENAI_API_ORG. Neither is needed if you only use other endpoints.
 
 Ficta also supports non-OpenAI completion endpoints that mimic the OpenAI
 v1/chat/completions endpoint.  To use a non-OpenAI completion endpoint, launch
@@ -72,10 +125,137 @@ request should be send to the URL endpoint.  For example,
    AI: url, 100, 0.700, 1
 
 The URL endpoint must accept a POST request with a JSON body that matches the
-OpenAI v1/chat/completions format.
+OpenAI v1/chat/completions format. Write "url:name" instead of "url" to send
+a model name along with the request.
+
+Fallback chains: the model field may list several models separated by '|',
+
+   AI: url:llama3 | gpt-4o-mini, 100, 0.700, 1
+
+ficta tries them in order, moving on when a model can't be reached or fails
+with one of the -fs status codes, and notes which model produced the text in
+a comment above the AI: line.
+
+More endpoints can be declared in the config file, each with its own URL and
+credentials: none, an environment variable, a key file or the output of a
+command such as a password manager. For example,
+
+   {"endpoints": {
+     "local": {"url": "http://localhost:8080/v1/chat/completions", "llama_cpp": true},
+     "work": {"auth": {"type": "command", "command": "pass show openai/work"}}}}
+
+and then "AI: local:llama3, 100, 0.700, 1" or "AI: work:gpt-4o, ...". Credentials
+are looked up when an endpoint is first used. OpenAI endpoints, including "url"
+and those declared with a url, take seed, top_p, presence_penalty,
+frequency_penalty and stop (sequences separated by '|') as key=value options
+after the positional fields. An option an endpoint doesn't have is an error.
+
+Ollama servers are supported through their native API, which exposes options
+the OpenAI compatible one doesn't. Use the "ollama" endpoint, which expects the
+server at http://localhost:11434, or configure one with "provider": "ollama".
+Options follow the positional fields of the AI: line as key=value pairs:
+
+   AI: ollama:llama3, 200, 0.700, 1, num_ctx=8192, keep_alive=30m
+
+mode=generate uses /api/generate instead of /api/chat, raw=true sends the text
+without the model's prompt template and stream=true streams the response.
+Sampler options, e.g. seed=42 or top_k=40, are passed on in Ollama's "options".
+
+The "llamacpp" endpoint sends the document as plain text to be continued, with
+no chat template, to the /completion endpoint of a llama.cpp server at
+http://localhost:8080 (configure others with "provider": "llamacpp"). Its
+sampler options can be set in the AI: line, e.g.
+
+   AI: llamacpp, 300, 0.400, 1, min_p=0.05, top_k=40, repeat_penalty=1.1
+
+along with mirostat, mirostat_tau, mirostat_eta, top_p, seed, stream=true and
+grammar=file.gbnf, a GBNF grammar file relative to the document.
+
+Anthropic models are used through the "anthropic" endpoint, which reads its
+API key from ANTHROPIC_API_KEY, e.g.
+
+   AI: anthropic:claude-3-5-sonnet-latest, 400, 0.700, 1, stream=true
+
+top_p and top_k may be set too. With any chat endpoint, system=file.txt sends
+the contents of the file, relative to the document, as the system prompt.
+
+Gemini models are used through the "gemini" endpoint, which reads its API key
+from GEMINI_API_KEY, e.g.
+
+   AI: gemini:gemini-1.5-pro, 400, 0.700, 2, top_k=40, stop=THE END
+
+stream=true, top_p, top_k, seed, presence_penalty, frequency_penalty and stop
+(sequences separated by '|') are translated into the generationConfig.
+
+stream=true is an option of the Ollama, llama.cpp, Anthropic and Gemini
+endpoints only: each reads the streamed response itself, and the file is
+written once the whole response has arrived, as it is without streaming.
+
+Directives: a line comment starting with '!' changes the next request only,
+and is removed from the file along with writing the response, e.g.
+
+   //! temp=0.9
+   //! stop=CHAPTER
+   //! instruct: write in present tense
+
+model, max_tokens, temp and n override the AI: line, other keys are options
+as if they were on the AI: line and instruct: adds to the system prompt.
+
+Variables: a line "@SET hero = Willy" defines hero, and {{hero}} in the text
+is replaced with Willy when the prompt is sent. The file keeps both. A value
+may use the variables defined above it and \{{hero}} is sent as {{hero}}. An
+undefined variable stops the request with an error comment in the file.
+
+Front matter: YAML between a first line "---" and the next "---" line sets
+model, max_tokens, temperature and n for documents without an AI: line, and
+endpoint, system, comments, stop, context (full or last N), output (append or
+side) and vars for the whole document. It is never sent, and the AI: line wins
+where both apply.
+
+Structured output: a line "@SCHEMA outline.json" in the text, or a JSON schema
+between a line "@SCHEMA" and a line "@END", asks for a response in JSON that
+matches the schema. It is not sent as part of the prompt. OpenAI compatible
+endpoints get it as the response_format, llama.cpp as a grammar and Ollama as
+the format. Responses that don't match are not written; the file gets an
+error comment instead.
 
 You may freely edit the AI: line in your documents to switch between OpenAI
-models and the URL endpoints.`
+models and the URL endpoints.
+
+Commands:
+   lsp  Run a Language Server Protocol server on stdin/stdout. Editors that
+        speak LSP get diagnostics for malformed AI: lines, completion of model
+        names, a hover showing the estimated prompt size and a "complete now"
+        code action that runs a completion on the unsaved buffer.
+   cache stats|clear
+        Show how often the response cache was used, or empty it.
+   compare file model [model ...]
+        Send the document's prompt to each model at once and write their
+        responses, time, token counts and cost side by side to file.compare.md.
+        Prices come from a built-in list and the config file's "prices".
+   provenance file [file ...]
+        Count the characters of each document written by the author and by
+        each model, according to the markers -pv writes.
+   export output file|dir [file|dir ...]
+        Write the documents, without AI: lines, comments, directives or
+        markers, as one manuscript. The extension of output, .md, .txt, .html
+        or .epub, picks the format; "-" writes the text to stdout. The
+        documents of a directory are taken in natural order.
+   stats [-json] file|dir [file|dir ...]
+        Show each document's words, the share the author and models wrote,
+        the estimated prompt tokens and, from the journal, the completion
+        rounds and words added each day. A directory's documents are totaled.
+   new [-t template] file [file ...]
+        Create each file from a template: story (the default), essay,
+        outline, dialogue, chat, or one of yours in the templates directory
+        next to the config file. A directory's .ficta-template file names the
+        template used there by default. new -l lists the templates.
+   check file|dir [file|dir ...]
+        Parse the documents without sending anything and report malformed
+        AI: lines, unterminated block comments, unknown directives, options
+        an endpoint doesn't take, missing schema, system prompt and grammar
+        files and other errors a request would hit, then the estimated prompt
+        size and cost. Exits with status 1 if any document has a problem.`
 
 var (
 	backupExt          string
@@ -86,15 +266,78 @@ var (
 	showJsonReq        bool // when true, ficta will print the json generated for each request.
 )
 
+// commands maps subcommand names to their implementations. A subcommand
+// receives the command line arguments that follow its name.
+var commands = map[string]func(args []string) error{
+	"lsp":        runLSP,
+	"cache":      runCache,
+	"compare":    runCompare,
+	"provenance": runProvenance,
+	"export":     runExport,
+	"stats":      runStats,
+	"new":        runNew,
+	"check":      runCheck,
+}
+
 func main() {
 	flag.StringVar(&backupExt, "b", "", "the extension for backup files")
 	flag.StringVar(&urlEndpoint, "u", "", "optional URL endpoint for non OpenAI completion requests")
 	flag.StringVar(&lineCommentPrefix, "c", "//", "the prefix string for comment lines")
 	flag.StringVar(&blockCommentPrefix, "y", "/*", "the prefix string for multi-line comments")
 	flag.StringVar(&blockCommentSuffix, "z", "*/", "the suffix string for multi-line comments")
+	flag.BoolVar(&nestedComments, "nb", false, "block comments may be nested")
 	flag.BoolVar(&showJsonReq, "j", false, "When true, ficta will print the json sent with each request")
+	flag.StringVar(&configPath, "f", "", "configuration file, default is ficta/config.json in the user config directory")
+	flag.IntVar(&maxRetries, "r", 2, "number of times a failed request is retried")
+	flag.DurationVar(&requestTimeout, "t", 2*time.Minute, "time limit for each request attempt, 0 for none")
+	flag.StringVar(&fallbackModels, "fb", "", "models, separated by '|', to try when those on the AI: line fail")
+	flag.StringVar(&fallbackStatus, "fs", "404,429,500,502,503,504", "HTTP status codes that move on to the next model")
+	flag.StringVar(&journalName, "J", ".ficta-journal.jsonl", "name of the request journal kept next to each document, '' for none")
+	flag.StringVar(&preHook, "pre", "", "command that receives the cleaned prompt on stdin and writes the prompt to send")
+	flag.StringVar(&postHook, "post", "", "command that receives each response on stdin and writes the text to insert")
+	flag.DurationVar(&hookTimeout, "ht", 30*time.Second, "maximum run time of a hook command")
+	flag.StringVar(&hookPolicy, "hf", hookPolicySkip, "hook failure policy: skip or abort")
+	flag.IntVar(&slotCount, "s", 1, "number of llama.cpp server slots to share out among documents")
+	flag.StringVar(&cacheMode, "cache", cacheAuto, "response cache: auto, on or off")
+	flag.StringVar(&cacheDir, "cd", defaultCacheDir(), "response cache directory")
+	flag.StringVar(&provenanceMode, "pv", provenanceOff, "provenance markers around responses: off, comment or invisible")
 	flag.Usage = func() { fmt.Println(USAGE) }
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		commentFlagsSet = commentFlagsSet || f.Name == "c" || f.Name == "y" || f.Name == "z"
+	})
+
+	// An explicit -f must exist; the default configuration file is optional.
+	required := configPath != ""
+	if !required {
+		configPath = defaultConfigPath()
+	}
+	if err := loadConfig(configPath, required); err != nil {
+		log.Println("Error:", err)
+		return
+	}
+
+	// Subcommands share the options above and take over the remaining args.
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cacheMode != cacheAuto && cacheMode != cacheOn && cacheMode != cacheOff {
+		log.Printf("Unknown cache mode %q, use %q, %q or %q", cacheMode, cacheAuto, cacheOn, cacheOff)
+		return
+	}
+	if provenanceMode != provenanceOff && provenanceMode != provenanceComment && provenanceMode != provenanceInvisible {
+		log.Printf("Unknown provenance mode %q, use %q, %q or %q", provenanceMode, provenanceOff, provenanceComment, provenanceInvisible)
+		return
+	}
+	if hookPolicy != hookPolicySkip && hookPolicy != hookPolicyAbort {
+		log.Printf("Unknown hook failure policy %q, use %q or %q", hookPolicy, hookPolicySkip, hookPolicyAbort)
+		return
+	}
 
 	files, errors := checkFileArgs(flag.Args())
 	if len(errors) > 0 {
@@ -107,18 +350,6 @@ func main() {
 		fmt.Println(USAGE)
 		return
 	}
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		log.Println("Please set the OPENAI_API_KEY environment variable")
-		fmt.Println(USAGE)
-		return
-	}
-	orgId := os.Getenv("OPENAI_API_ORG")
-	if orgId == "" {
-		log.Println("Please set the OPENAI_API_ORG environment variable")
-		fmt.Println(USAGE)
-		return
-	}
 	// Create a watcher.
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -130,72 +361,101 @@ func main() {
 	done := make(chan bool)
 
 	// Enter a goroutine that watches for changes to the files.
-	go func() {
-		// make a map each filename that is being watched to a bool. We use this to determine if the
-		// last file change was done when we appended a response.
-		watchedFiles := make(map[string]bool)
-		for _, f := range files {
-			watchedFiles[f] = false
+	go watchFiles(watcher, files)
+
+	// Add our filenames to the watcher.
+	for _, file := range files {
+		err = watcher.Add(file)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
 		}
-		log.Printf("Listening for changes to %q", files)
-		for {
-			select {
-			case event, ok := <-watcher.Events:
+	}
+	// Wait forever, allowing the goroutine to handle the file changes.
+	<-done
+}
+
+// watchFiles requests a completion each time the author saves one of files,
+// the files watched by watcher, and writes the response back to the file. It
+// returns when the watcher is closed.
+func watchFiles(watcher *fsnotify.Watcher, files []string) {
+	// Map each watched filename to the text we last wrote to it. Saving a file
+	// can raise more than one write event, so rather than counting events we
+	// compare the file with what we wrote to avoid having our own writes cause
+	// a send to the API endpoint.
+	written := make(map[string]string)
+	for _, f := range files {
+		written[f] = ""
+	}
+	// remember records the text of a file we just wrote.
+	remember := func(name string) {
+		if text, err := os.ReadFile(name); err == nil {
+			written[name] = string(text)
+		}
+	}
+	log.Printf("Listening for changes to %q", files)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write {
+				// We have a write event. The filename is given by event.Name.
+				last, ok := written[event.Name]
 				if !ok {
-					return
+					continue
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					// We have a write event. The filename is given by event.Name.
-					// The watchedFiles map has the names of the files we're watching
-					// as keys and a bool indicating if the last file change was done
-					// when we appended a response from the API. We want to avoid having
-					// those writes cause a send to the API endpoint.
-					if v, ok := watchedFiles[event.Name]; ok && v {
-						// clear the flag and ignore the write event
-						// because it was triggered by our writing the
-						// response to the file.
-						watchedFiles[event.Name] = false
-						continue
-					}
-					// if we get here, then the last file change was done by the user.
-					log.Printf("file changed: %s", event.Name)
-					start := time.Now()
-					// Call the completion API
-					response, err := requestCompletion(event.Name, apiKey, orgId)
+				if text, err := os.ReadFile(event.Name); err == nil && string(text) == last {
+					// The write was ours, or the file hasn't changed since.
+					continue
+				}
+				// if we get here, then the last file change was done by the user.
+				log.Printf("file changed: %s", event.Name)
+				start := time.Now()
+				// Call the completion API
+				response, err := requestCompletion(event.Name)
+				if err != nil {
+					log.Println(err)
+					written, err := reportRequestError(event.Name, err)
 					if err != nil {
 						log.Println(err)
 						continue
 					}
-					log.Printf("response received: %0.3f elapsed", time.Since(start).Seconds())
-
-					// Rewrite the file with the new content.
-					err = overwriteFile(event.Name, backupExt, response)
-					if err != nil {
-						log.Println(err)
-						continue
+					if written {
+						remember(event.Name)
 					}
-					// Set a flag so that our write doesn't retrigger change handler.
-					watchedFiles[event.Name] = true
+					continue
 				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
+				log.Printf("response received: %0.3f elapsed", time.Since(start).Seconds())
+
+				// Rewrite the file with the new content.
+				err = overwriteFile(event.Name, backupExt, response)
+				if err != nil {
+					log.Println(err)
+					continue
 				}
-				fmt.Println("Error:", err)
+				// Remember our write so that it doesn't retrigger the change handler.
+				remember(event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
 			}
-		}
-	}()
-
-	// Add our filenames to the watcher.
-	for _, file := range files {
-		err = watcher.Add(file)
-		if err != nil {
 			fmt.Println("Error:", err)
-			return
 		}
 	}
-	// Wait forever, allowing the goroutine to handle the file changes.
-	<-done
+}
+
+// reportRequestError puts err, the error of a request for filename, where
+// the author is looking: in a note above the AI: line. A hook that abandoned
+// the request leaves the file exactly as it was saved. written reports
+// whether the file was changed.
+func reportRequestError(filename string, err error) (written bool, _ error) {
+	if errors.Is(err, errHookAbort) {
+		return false, nil
+	}
+	return true, annotateFile(filename, err)
 }
 
 // checkFileArgs receives a slice of filenames.  Any filenames that don't exist
@@ -220,14 +480,18 @@ func checkFileArgs(filenames []string) ([]string, []error) {
 					file.Close()
 					continue
 				}
-				goodfiles = append(goodfiles, filename)
-				// insert default content into file
-				err := writeDefaultFileContent(file)
+				// start the file from its directory's template, so it is
+				// only watched once it has one
+				content, err := newDocument(filename, "", time.Now())
+				if err == nil {
+					_, err = file.WriteString(content)
+				}
 				if err != nil {
 					errors = append(errors, err)
 					file.Close()
 					continue
 				}
+				goodfiles = append(goodfiles, filename)
 				defer file.Close()
 			}
 		} else {
@@ -252,134 +516,225 @@ func checkFileArgs(filenames []string) ([]string, []error) {
 	return goodfiles, errors
 }
 
-// requestCompletion takes a file name and an openai API key and organization id
-// and sends the file's content to the OpenAI completion endpoint.  It returns
-// the response from the OpenAI completion endpoint and an error if one
-// occurred.
-func requestCompletion(filename, apiKey, org string) (response string, err error) {
-	organization := os.Getenv("OPENAI_API_ORG")
-
-	client := goopenai.NewClient(apiKey, organization)
+// requestCompletion takes a file name and sends the file's content to the
+// completion endpoint.  It returns the response from the completion endpoint
+// and an error if one occurred. Each request, successful or not, is recorded in the journal.
+func requestCompletion(filename string) (response string, err error) {
 	text, err := os.ReadFile(filename)
 	if err != nil {
 		log.Println("Error:", err)
 		return
 	}
-	textstr, aiLine := findLastAILine(string(text))
-	cleanText := processAuthorComments(textstr, lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
-	model, req_tokens, temperature, cnt, err := parseAILine(aiLine)
+	start := time.Now()
+	response, entry, err := completeText(string(text), filename)
+	entry.Time = start
+	entry.Elapsed = time.Since(start).Seconds()
 	if err != nil {
-		log.Printf("Using default model parameters: Error: %v", err)
+		entry.Error = err.Error()
+	}
+	if jerr := appendJournal(filename, entry); jerr != nil {
+		log.Println("journal:", jerr)
 	}
-	// Escape special characters in text
-	escapedText, err := json.Marshal(cleanText)
+	return response, err
+}
+
+// completeText sends the prompt contained in text to the completion endpoint
+// selected by its AI: line and returns text followed by the response and a new
+// AI: line, or just the AI: line if its front matter sends the responses to a
+// side file. Apart from that side file, it is the part of requestCompletion
+// that doesn't touch the file system, so it can also be used on unsaved editor
+// buffers. filename is the document's path, empty if it has none; file names
+// in the AI: line are resolved against its directory. The returned journal
+// entry describes the request, whether or not it succeeded.
+func completeText(text, filename string) (response string, entry journalEntry, err error) {
+	doc, entry, err := prepareDocument(text, filename)
 	if err != nil {
-		log.Println("Error:", err)
-		return
+		return "", entry, err
 	}
-	// If the model name is "url", call the URL endpoint given when the program
-	// started. Otherwise call the OpenAI API completion endpoint.
-	url := ""
-	maxtok := req_tokens // need to copy req_tokens because models take a pointer to it.
-	r := goopenai.CreateChatCompletionsRequest{
-		Messages: []goopenai.Message{
-			{
-				Role:    "user",
-				Content: string(escapedText),
-			},
-		},
-		Model:       model,
-		Temperature: 2 * temperature, // OpenAI API temperature range is 0.0 to 2.0
-		MaxTokens:   &maxtok,
-		N:           &cnt,
-	}
-	// Extra information needed for url endpoints
-	cache_prompt := false
-	slot_id := 0
-	/*
-		    llcp := goopenai.LlamaCppParams{
-			CachePrompt: &cache_prompt,
-			SlotId:      &slot_id,
-		} */
-	if model == "url" {
-		url = urlEndpoint
-		cache_prompt = true
-		r.CachePrompt = &cache_prompt
-		r.SlotId = &slot_id
-	}
-
-	ctx := context.Background()
-	completions, err := client.CreateChatCompletions(ctx, &r, url)
-	if showJsonReq {
-		jsn, err := json.Marshal(r)
-		if err != nil {
-			log.Print(err)
-		} else {
-			log.Print(string(jsn))
+	req := doc.req
+	// Walk the fallback chain until one of the models answers.
+	chain := modelChain(doc.model)
+	var (
+		result completion
+		used   string
+	)
+	for i, spec := range chain {
+		result, err = sendChat(context.Background(), spec, req)
+		entry.PromptTokens, entry.CompletionTokens, entry.Cached = result.PromptTokens, result.CompletionTokens, result.Cached
+		if err == nil {
+			used = spec
+			break
 		}
+		if i == len(chain)-1 || !shouldFallBack(err) {
+			return "", entry, err
+		}
+		log.Printf("%s failed: %v; falling back to %s", spec, err, chain[i+1])
+	}
+	entry.UsedModel = used
+	ep, _ := resolveModel(used)
+	raw := ep.temperature(req)
+	entry.RawTemperature = &raw
+	// Create and append model, token limit and temperature as the final line
+	// of the response. When the AI: line has a fallback chain, an author
+	// comment records which model produced the text.
+	ai := "\n\n" + doc.trailer
+	if len(chain) > 1 {
+		ai = "\n\n" + doc.syntax.comment(producedByTag+" "+used) + ai
 	}
-	if err != nil {
-		return "", err
-	}
-	// fmt.Printf("AI: %s, %d, %f, %d\n", model, max_tokens, temperature, cnt)
-	// fmt.Printf("Request\n%v\n", r)
-	// fmt.Printf("Completions\n%v\n", completions)
-	/* Response should be like this
-	{
-	  "id": "chatcmpl-xxx",
-	  "object": "chat.completion",
-	  "created": 1678667132,
-	  "model": "gpt-3.5-turbo-0301",
-	  "usage": {
-	    "prompt_tokens": 13,
-	    "completion_tokens": 7,
-	    "total_tokens": 20
-	  },
-	  "choices": [
-	    {
-	      "message": {
-	        "role": "assistant",
-	        "content": "\n\nThis is a test!"
-	      },
-	      "finish_reason": "stop",
-	      "index": 0
-	    }
-	  ]
-	}
-	*/
-	// Log the response token counts
-	pt := completions.Usage.PromptTokens
-	ct := completions.Usage.CompletionTokens
-	tt := completions.Usage.TotalTokens
-	log.Printf("tokens: prompt=%d, completion=%d, total=%d\n", pt, ct, tt)
-	// Create and append model, token limit and temperature as the final line of the response.
-	// Remember that temp needs to be scaled down by a factor of 2.
-	mdl := r.Model
-	// maxt := r.MaxTokens
-	temp := r.Temperature
-	cnt = *r.N
-	ai := fmt.Sprintf("\n\nAI: %s, %d, %0.3f, %d", mdl, req_tokens, temp/2, cnt)
 	var responses []string
-	nChoices := len(completions.Choices)
-	switch {
-	case nChoices == 1:
-		for _, s := range completions.Choices {
-			responses = append(responses, s.Message.Content)
+	now := time.Now()
+	nChoices := len(result.Choices)
+	for i, s := range result.Choices {
+		content, err := finishResponse(s, used, req)
+		if err != nil {
+			return "", entry, err
 		}
-	case nChoices > 1:
-		for i, s := range completions.Choices {
+		if nChoices > 1 {
 			// precede each response with a line comment of the from "response n of m"
-			responses = append(responses, fmt.Sprintf("%s response %d of %d", lineCommentPrefix, i+1, nChoices))
-			responses = append(responses, s.Message.Content)
+			responses = append(responses, doc.syntax.comment(fmt.Sprintf("response %d of %d", i+1, nChoices)))
 		}
-	default:
+		responses = append(responses, markProvenance(content, used, now, doc.syntax))
+	}
+	if nChoices == 0 {
 		responses = append(responses, "bad choice count")
 	}
-	// catenate the prompt, the response and the AI string. For reasons that
-	// aren't yet clear, the responses sometimes contain escape sequences for
-	// quotes, tabs and newlines. The unescape function fixes any that are
-	// found.
-	return textstr + unescape(strings.Join(responses, "\n\n")) + ai, err
+	if doc.output == outputSide {
+		// The responses go to the side file; the document gets only the
+		// new AI: line.
+		side := strings.Join(responses, "\n\n") + strings.TrimSuffix(ai, "\n\n"+doc.trailer)
+		if err := appendSideFile(filename, side); err != nil {
+			return "", entry, err
+		}
+		response = strings.TrimRight(doc.text, "\n") + "\n\n" + doc.trailer
+		entry.Words = countWords(response, filename)
+		return response, entry, nil
+	}
+	// catenate the prompt, the responses and the AI string.
+	response = doc.text + strings.Join(responses, "\n\n") + ai
+	entry.Words = countWords(response, filename)
+	return response, entry, nil
+}
+
+// finishResponse returns response s from the model spec as it is to be
+// written. A response to a request with a schema must be JSON that matches
+// it. For reasons that aren't yet clear, other responses sometimes contain
+// escape sequences for quotes, tabs and newlines, which are fixed. Then the
+// post-hook sees the response.
+func finishResponse(s, spec string, req completionRequest) (string, error) {
+	if req.Schema != nil {
+		var err error
+		if s, err = checkStructured(s, req.Schema); err != nil {
+			return "", fmt.Errorf("%s: %w", spec, err)
+		}
+	} else {
+		s = unescape(s)
+	}
+	return runPostHook(s, spec)
+}
+
+// preparedDocument is a document ready to be sent to a model.
+type preparedDocument struct {
+	text    string            // the document up to its AI: line, without error notes
+	model   string            // the model field of the AI: line, or a directive's
+	trailer string            // the AI: line to write after the response
+	req     completionRequest // the request for the rest of the AI: line
+	syntax  commentSyntax     // the document's comment syntax
+	output  string            // the front matter's output mode
+}
+
+// prepareDocument parses text, the contents of the document filename, and
+// builds the request for its AI: line. The returned journal entry describes
+// the request.
+func prepareDocument(text, filename string) (doc preparedDocument, entry journalEntry, err error) {
+	doc, entry, err = preparePrompt(text, filename)
+	if err != nil {
+		return doc, entry, err
+	}
+	doc.req.Prompt, err = runPreHook(doc.req.Prompt, doc.model)
+	return doc, entry, err
+}
+
+// preparePrompt is prepareDocument without the pre-hook, so nothing outside
+// ficta sees the prompt.
+func preparePrompt(text, filename string) (doc preparedDocument, entry journalEntry, err error) {
+	// The front matter is written back as it is and never sent.
+	front, body := splitFrontMatter(text)
+	fm, frontErr := parseFrontMatter(front)
+	textstr, aiLine := findLastAILine(body)
+	syntax, syntaxErr := commentSyntaxFor(filename, text)
+	// Error notes from earlier failed requests are stale once we try again.
+	textstr = removeErrorAnnotations(textstr, syntax)
+	// Directives apply to this request only and are removed along with
+	// writing the response.
+	textstr, directives, directiveErr := extractDirectives(textstr, syntax)
+	cleanText := removeInvisibleMarkers(stripAuthorComments(removeModeline(textstr), filename, syntax))
+	model, req_tokens, temperature, cnt, err := parseAILine(aiLine)
+	if err != nil && (aiLine != "" || front == "") {
+		log.Printf("Using default model parameters: Error: %v", err)
+	}
+	// The options were validated by parseAILine and are ignored along with
+	// the rest of a malformed line.
+	var opts map[string]string
+	if err == nil {
+		opts, _ = parseAIOptions(aiLine)
+	}
+	// The front matter fills in what the AI: line doesn't give.
+	s := fm.settings(requestSettings{model: model, maxTokens: req_tokens, temperature: temperature, n: cnt, opts: resolveOptionPaths(opts, "")}, err == nil)
+	trailer := fmt.Sprintf("AI: %s, %d, %0.3f, %d%s", s.model, s.maxTokens, s.temperature, s.n, formatAIOptions(opts))
+	for _, d := range directives {
+		if directiveErr == nil {
+			directiveErr = s.apply(d)
+		}
+		entry.Directives = append(entry.Directives, d.String())
+	}
+	s.model = withEndpoint(s.model, fm.Endpoint)
+	entry.Model, entry.MaxTokens, entry.Temperature, entry.N = s.model, s.maxTokens, s.temperature, s.n
+	if frontErr != nil {
+		return doc, entry, frontErr
+	}
+	if syntaxErr != nil {
+		return doc, entry, syntaxErr
+	}
+	if directiveErr != nil {
+		return doc, entry, directiveErr
+	}
+	dir := ""
+	if filename != "" {
+		dir = filepath.Dir(filename)
+	}
+	cleanText, err = substituteVariables(cleanText, fm.Vars)
+	if err != nil {
+		return doc, entry, err
+	}
+	cleanText, schema, err := extractSchema(cleanText, dir)
+	if err != nil {
+		return doc, entry, err
+	}
+	limit, _ := fm.contextLimit()
+	cleanText = limitContext(cleanText, limit)
+	req := completionRequest{
+		Doc:         filename,
+		Prompt:      cleanText,
+		MaxTokens:   s.maxTokens,
+		Temperature: s.temperature,
+		N:           s.n,
+		Options:     resolveOptionPaths(s.opts, dir),
+		Schema:      schema,
+		System:      strings.TrimSpace(fm.System),
+	}
+	if err := readSystemPrompt(&req); err != nil {
+		return doc, entry, err
+	}
+	if len(s.instructions) > 0 {
+		req.System = strings.TrimSpace(req.System + "\n\n" + strings.Join(s.instructions, "\n"))
+	}
+	if err := readRawTemperature(&req); err != nil {
+		return doc, entry, err
+	}
+	if err := readCacheOption(&req); err != nil {
+		return doc, entry, err
+	}
+	return preparedDocument{text: front + textstr, model: s.model, trailer: trailer, req: req, syntax: syntax, output: fm.Output}, entry, nil
 }
 
 // findLastAILine returns the AI: line that contains the model, max tokens and
@@ -415,8 +770,13 @@ func parseAILine(line string) (string, int, float64, int, error) {
 	defaults := func(err error) (string, int, float64, int, error) {
 		return "gpt-3.5-turbo", 100, 0.7, 2, err
 	}
-	// Split line into fields
+	// Split line into fields. Any key=value options after the positional
+	// fields are checked by parseAIOptions.
 	fields := strings.Split(line, ",")
+	if _, err := parseAIOptions(line); err != nil {
+		return defaults(err)
+	}
+	fields = fields[:positionalFields(fields)]
 	if len(fields) < 3 || len(fields) > 4 {
 		return defaults(fmt.Errorf("Invalid number of fields in line: %q", line))
 	}
@@ -473,6 +833,56 @@ func parseAILine(line string) (string, int, float64, int, error) {
 	return model, maxToks, flt, nResp, nil
 }
 
+// estimateTokens returns a rough estimate of the number of tokens a model
+// will see for text. Most tokenizers average about four characters per token
+// for English prose, which is close enough for sizing prompts.
+func estimateTokens(text string) int {
+	return (len([]rune(text)) + 3) / 4
+}
+
+// parseAIOptions returns the key=value options that may follow the positional
+// fields of an AI: line, e.g. "AI: ollama:llama3, 200, 0.7, 1, num_ctx=8192".
+// Which options an endpoint takes is checked when the request is made; one
+// it doesn't take is an error.
+func parseAIOptions(line string) (map[string]string, error) {
+	fields := strings.Split(line, ",")
+	opts := make(map[string]string)
+	for _, f := range fields[positionalFields(fields):] {
+		key, value, ok := strings.Cut(f, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Invalid option field %q in line: %q", strings.TrimSpace(f), line)
+		}
+		opts[key] = strings.TrimSpace(value)
+	}
+	return opts, nil
+}
+
+// positionalFields returns the number of fields before the first key=value
+// option.
+func positionalFields(fields []string) int {
+	for i, f := range fields {
+		if strings.Contains(f, "=") {
+			return i
+		}
+	}
+	return len(fields)
+}
+
+// formatAIOptions formats options for the end of an AI: line, sorted by key.
+func formatAIOptions(opts map[string]string) string {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, ", %s=%s", k, opts[k])
+	}
+	return b.String()
+}
+
 // unescape unescapes a string, replacing backslash escaped characters with
 // the corresponding unescaped runes.
 func unescape(input string) string {
@@ -511,18 +921,6 @@ func unescape(input string) string {
 	return buf.String()
 }
 
-// writeDefaultFileContent is called to put some initial content into
-// files that ficta creates.
-func writeDefaultFileContent(file *os.File) error {
-	const defaultContent = `Continue the story that starts below.
-
-Once upon a time there were three weasels named Willy, Worgus and Wishbone. One bright spring morning, Willy said to Worgus, "Hey, dude, what's for breakfast?"
-
-AI: gpt-3.5-turbo, 100, 0.700, 1`
-	_, err := file.WriteString(defaultContent)
-	return err
-}
-
 // overwriteFile rewrites a file with new content. If backExt is not "", it
 // creates a backup of the original file with the given extension.
 func overwriteFile(filename, bakExt, newContent string) error {
@@ -583,33 +981,3 @@ func replaceExtension(filename, newExt string) string {
 		return fname + "." + strings.TrimPrefix(newExt, ".")
 	}
 }
-
-// processAuthorComments removes the author comments from a text string.
-// The arguments lcprefix, bcprefix, and lcprefix2 are comment delimiters
-// for line and block comments.
-func processAuthorComments(text, lcprefix, bcprefix, bcsuffix string) string {
-	var (
-		include = true
-	)
-	lines := strings.Split(text, "\n")
-	stripped := []string{} // accumulator for lines that aren't commented out
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, lcprefix) {
-			continue // reject line comments
-		}
-		if strings.HasSuffix(trimmed, bcsuffix) {
-			include = true
-			continue
-		}
-		if strings.HasPrefix(trimmed, bcprefix) {
-			include = false
-			continue
-		}
-		// Line is not commented out, so add it to the accumulator
-		if include {
-			stripped = append(stripped, line)
-		}
-	}
-	return strings.Join(stripped, "\n")
-}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -34,6 +35,29 @@ func TestParseAILine(t *testing.T) {
 			expectedCompletions: 2,
 			expectedErr:         "",
 		},
+		{
+			name:                "Valid Input, with options",
+			input:               "AI:test,42,0.42,2, num_ctx=8192, keep_alive=5m",
+			expectedModel:       "test",
+			expectedMaxTokens:   42,
+			expectedTemperature: 0.42,
+			expectedCompletions: 2,
+			expectedErr:         "",
+		},
+		{
+			name:                "Valid Input, options without count",
+			input:               "AI:test,42,0.42,seed=1",
+			expectedModel:       "test",
+			expectedMaxTokens:   42,
+			expectedTemperature: 0.42,
+			expectedCompletions: 1,
+			expectedErr:         "",
+		},
+		{
+			name:        "Invalid Option",
+			input:       "AI:test,42,0.42,seed=1,oops",
+			expectedErr: "Invalid option field",
+		},
 		{
 			name:        "Invalid Prefix",
 			input:       "AIt:test,42,0.42",
@@ -105,6 +129,18 @@ func TestParseAILine(t *testing.T) {
 		})
 	}
 }
+func TestParseAIOptions(t *testing.T) {
+	opts, err := parseAIOptions("AI: ollama:llama3, 200, 0.7, 1, num_ctx = 8192, raw=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 2 || opts["num_ctx"] != "8192" || opts["raw"] != "true" {
+		t.Errorf("Unexpected options %v", opts)
+	}
+	if s := formatAIOptions(opts); s != ", num_ctx=8192, raw=true" {
+		t.Errorf("Unexpected formatted options %q", s)
+	}
+}
 func TestUnescape(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -367,6 +403,27 @@ func TestCheckFileArgs(t *testing.T) {
 	}
 }
 
+func TestCheckFileArgsTemplate(t *testing.T) {
+	dir := t.TempDir()
+	story := filepath.Join(dir, "story.ait")
+	good, errs := checkFileArgs([]string{story})
+	if len(good) != 1 || len(errs) != 0 {
+		t.Fatalf("Expected the new file to be watched, got %v, %v", good, errs)
+	}
+	if text, err := os.ReadFile(story); err != nil || !strings.Contains(string(text), "\nAI: ") {
+		t.Errorf("Expected the new file to hold its template, got %q, %v", text, err)
+	}
+
+	// A new file without a template is not watched.
+	if err := os.WriteFile(filepath.Join(dir, directoryTemplateName), []byte("sonnet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	good, errs = checkFileArgs([]string{filepath.Join(dir, "poem.ait")})
+	if len(good) != 0 || len(errs) != 1 || !strings.Contains(errs[0].Error(), `unknown template "sonnet"`) {
+		t.Errorf("Expected a template error and no file, got %v, %v", good, errs)
+	}
+}
+
 func TestProcessAuthorComments(t *testing.T) {
 	text := `
 // This is a comment
@@ -0,0 +1,198 @@
+package main
+
+// Ollama's OpenAI compatibility layer hides options such as num_ctx,
+// keep_alive and raw mode, so endpoints with "provider": "ollama" are sent
+// requests in Ollama's native /api/chat or /api/generate format instead.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ollamaRequest is the body of a /api/chat or /api/generate request.
+type ollamaRequest struct {
+	Model     string                 `json:"model"`
+	Messages  []ollamaMessage        `json:"messages,omitempty"` // chat
+	Prompt    string                 `json:"prompt,omitempty"`   // generate
+	System    string                 `json:"system,omitempty"`   // generate
+	Raw       bool                   `json:"raw,omitempty"`      // generate without the prompt template
+	Stream    bool                   `json:"stream"`             // Ollama streams unless told not to
+	KeepAlive interface{}            `json:"keep_alive,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	Format    json.RawMessage        `json:"format,omitempty"` // a JSON schema
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ollamaOptions are the AI: line options of Ollama endpoints. mode, raw,
+// stream and keep_alive shape the request; the rest are sent in its options.
+var ollamaOptions = map[string]optionSpec{
+	"mode":              {"mode", optionString},
+	"raw":               {"raw", optionBool},
+	"stream":            {"stream", optionBool},
+	"keep_alive":        {"keep_alive", optionString},
+	"num_ctx":           {"num_ctx", optionInt},
+	"num_keep":          {"num_keep", optionInt},
+	"num_gpu":           {"num_gpu", optionInt},
+	"num_thread":        {"num_thread", optionInt},
+	"num_batch":         {"num_batch", optionInt},
+	"seed":              {"seed", optionInt},
+	"top_k":             {"top_k", optionInt},
+	"top_p":             {"top_p", optionFloat},
+	"min_p":             {"min_p", optionFloat},
+	"typical_p":         {"typical_p", optionFloat},
+	"repeat_last_n":     {"repeat_last_n", optionInt},
+	"repeat_penalty":    {"repeat_penalty", optionFloat},
+	"presence_penalty":  {"presence_penalty", optionFloat},
+	"frequency_penalty": {"frequency_penalty", optionFloat},
+	"mirostat":          {"mirostat", optionInt},
+	"mirostat_tau":      {"mirostat_tau", optionFloat},
+	"mirostat_eta":      {"mirostat_eta", optionFloat},
+	"penalize_newline":  {"penalize_newline", optionBool},
+	"stop":              {"stop", optionList},
+}
+
+// ollamaResponse is a complete response or one chunk of a streamed one.
+type ollamaResponse struct {
+	Message         ollamaMessage `json:"message"`  // chat
+	Response        string        `json:"response"` // generate
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+// ollamaCompleter sends requests to an Ollama server. Ollama returns one
+// response per request, so n completions take n requests.
+type ollamaCompleter struct{}
+
+func (ollamaCompleter) Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error) {
+	var result completion
+	r, path, err := ollamaRequestFor(req.Model, req.Prompt, req.System, req.MaxTokens, ep.temperature(req), req.Options)
+	if err != nil {
+		return result, err
+	}
+	r.Format = req.Schema
+	headers := make(map[string]string)
+	key, err := ep.apiKey()
+	if err != nil {
+		return result, err
+	}
+	if key != "" {
+		// For Ollama servers behind an authenticating proxy.
+		headers["Authorization"] = "Bearer " + key
+	}
+	url := strings.TrimSuffix(ep.URL, "/") + path
+	for i := 0; i < req.N; i++ {
+		var resp ollamaResponse
+		err = withRetries(ctx, func(ctx context.Context) error {
+			var err error
+			resp, err = ollamaPost(ctx, url, headers, r)
+			return err
+		})
+		if err != nil {
+			return completion{}, err
+		}
+		result.Choices = append(result.Choices, resp.Message.Content)
+		result.PromptTokens += resp.PromptEvalCount
+		result.CompletionTokens += resp.EvalCount
+	}
+	log.Printf("tokens: prompt=%d, completion=%d, total=%d\n", result.PromptTokens, result.CompletionTokens, result.PromptTokens+result.CompletionTokens)
+	return result, nil
+}
+
+// ollamaRequestFor builds the request for the AI: line options and returns it
+// with the API path to send it to.
+func ollamaRequestFor(model, prompt, system string, maxTokens int, temperature float64, opts map[string]string) (*ollamaRequest, string, error) {
+	req := &ollamaRequest{
+		Model: model,
+		Options: map[string]interface{}{
+			"temperature": temperature,
+			"num_predict": maxTokens,
+		},
+	}
+	generate := false
+	for k, v := range opts {
+		spec, err := lookupOption(providerOllama, ollamaOptions, k)
+		if err != nil {
+			return nil, "", err
+		}
+		value, err := spec.value(v)
+		switch k {
+		case "mode":
+			if v != "chat" && v != "generate" {
+				err = errors.New("must be chat or generate")
+			}
+			generate = generate || v == "generate"
+		case "raw":
+			req.Raw = err == nil && value.(bool)
+			generate = generate || req.Raw
+		case "stream":
+			req.Stream = err == nil && value.(bool)
+		case "keep_alive":
+			// A number of seconds or a duration such as 30m.
+			req.KeepAlive = v
+			if n, err := strconv.Atoi(v); err == nil {
+				req.KeepAlive = n
+			}
+		default:
+			req.Options[spec.field] = value
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("option %s=%s: %w", k, v, err)
+		}
+	}
+	if generate {
+		req.Prompt = prompt
+		req.System = system
+		return req, "/api/generate", nil
+	}
+	if system != "" {
+		req.Messages = append(req.Messages, ollamaMessage{Role: "system", Content: system})
+	}
+	req.Messages = append(req.Messages, ollamaMessage{Role: "user", Content: prompt})
+	return req, "/api/chat", nil
+}
+
+// ollamaPost sends req and returns the response. A streamed response arrives
+// as newline delimited JSON chunks, which are assembled into one.
+func ollamaPost(ctx context.Context, url string, headers map[string]string, req *ollamaRequest) (ollamaResponse, error) {
+	var total ollamaResponse
+	resp, err := postJSON(ctx, url, headers, req)
+	if err != nil {
+		return total, err
+	}
+	defer resp.Body.Close()
+	var text strings.Builder
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var chunk ollamaResponse
+		err := dec.Decode(&chunk)
+		if err == io.EOF {
+			return total, errors.New("ollama: response ended early")
+		}
+		if err != nil {
+			return total, err
+		}
+		if chunk.Error != "" {
+			return total, errors.New("ollama: " + chunk.Error)
+		}
+		text.WriteString(chunk.Message.Content)
+		text.WriteString(chunk.Response)
+		if chunk.Done {
+			total = chunk
+			break
+		}
+	}
+	total.Message.Content = text.String()
+	return total, nil
+}
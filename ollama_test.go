@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ollamaStandIn is an httptest server that answers like Ollama and records
+// the requests it receives.
+func ollamaStandIn(t *testing.T, requests *[]ollamaRequest, paths *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ollamaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		*requests = append(*requests, req)
+		*paths = append(*paths, r.URL.Path)
+		if req.Model == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "model \"missing\" not found"}`)
+			return
+		}
+		field := `"message": {"role": "assistant", "content": %q}`
+		if r.URL.Path == "/api/generate" {
+			field = `"response": %q`
+		}
+		if !req.Stream {
+			fmt.Fprintf(w, `{`+field+`, "done": true, "prompt_eval_count": 10, "eval_count": 3}`, "Hello there.")
+			return
+		}
+		for _, word := range []string{"Hello", " there", "."} {
+			fmt.Fprintf(w, `{`+field+`, "done": false}`+"\n", word)
+		}
+		fmt.Fprintf(w, `{`+field+`, "done": true, "prompt_eval_count": 10, "eval_count": 3}`+"\n", "")
+	}))
+}
+
+// ollamaTestRequest returns a request for n completions of "Say hello.".
+func ollamaTestRequest(model string, n int, opts map[string]string) completionRequest {
+	return completionRequest{Model: model, Prompt: "Say hello.", MaxTokens: 50, Temperature: 0.5, N: n, Options: opts}
+}
+
+func TestOllamaCompleter(t *testing.T) {
+	var (
+		requests []ollamaRequest
+		paths    []string
+	)
+	server := ollamaStandIn(t, &requests, &paths)
+	defer server.Close()
+	ep := &endpoint{Name: "ollama", URL: server.URL, Provider: providerOllama}
+
+	tests := []struct {
+		name         string
+		opts         map[string]string
+		n            int
+		expectedPath string
+	}{
+		{name: "Chat", n: 1, expectedPath: "/api/chat"},
+		{name: "Chat streamed", opts: map[string]string{"stream": "true"}, n: 1, expectedPath: "/api/chat"},
+		{name: "Generate raw streamed", opts: map[string]string{"raw": "true", "stream": "true"}, n: 1, expectedPath: "/api/generate"},
+		{name: "Two responses", opts: map[string]string{"mode": "generate"}, n: 2, expectedPath: "/api/generate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, paths = nil, nil
+			c, err := ollamaCompleter{}.Complete(context.Background(), ep, ollamaTestRequest("llama3", tt.n, tt.opts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.Choices) != tt.n || c.Choices[0] != "Hello there." {
+				t.Errorf("Unexpected choices %q", c.Choices)
+			}
+			if c.PromptTokens != 10*tt.n || c.CompletionTokens != 3*tt.n {
+				t.Errorf("Unexpected token counts %d, %d", c.PromptTokens, c.CompletionTokens)
+			}
+			if paths[0] != tt.expectedPath {
+				t.Errorf("Expected %s, got %s", tt.expectedPath, paths[0])
+			}
+		})
+	}
+
+	// Options reach the request.
+	requests = nil
+	_, err := ollamaCompleter{}.Complete(context.Background(), ep, ollamaTestRequest("llama3", 1, map[string]string{"num_ctx": "8192", "keep_alive": "30m", "stop": "CHAPTER|THE END"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := requests[0]
+	if req.Options["num_ctx"] != float64(8192) || req.Options["num_predict"] != float64(50) || req.KeepAlive != "30m" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if stop, _ := req.Options["stop"].([]interface{}); len(stop) != 2 || stop[0] != "CHAPTER" || stop[1] != "THE END" {
+		t.Errorf("Expected two stop sequences, got %v", req.Options["stop"])
+	}
+	if len(req.Messages) != 1 || req.Messages[0].Content != "Say hello." {
+		t.Errorf("Unexpected messages %+v", req.Messages)
+	}
+}
+
+func TestOllamaCompleterErrors(t *testing.T) {
+	defer func(r int, s func(time.Duration)) { maxRetries, sleep = r, s }(maxRetries, sleep)
+	maxRetries, sleep = 0, func(time.Duration) {}
+	var (
+		requests []ollamaRequest
+		paths    []string
+	)
+	server := ollamaStandIn(t, &requests, &paths)
+	defer server.Close()
+	ep := &endpoint{Name: "ollama", URL: server.URL, Provider: providerOllama}
+
+	_, err := ollamaCompleter{}.Complete(context.Background(), ep, ollamaTestRequest("missing", 1, nil))
+	se, ok := err.(*statusError)
+	if !ok || se.StatusCode != http.StatusNotFound || !strings.Contains(se.Message, "not found") {
+		t.Errorf("Expected a 404 statusError, got %v", err)
+	}
+	defer func(fs string) { fallbackStatus = fs }(fallbackStatus)
+	fallbackStatus = "404"
+	if !shouldFallBack(err) {
+		t.Errorf("Expected a missing model to fall back")
+	}
+	_, err = ollamaCompleter{}.Complete(context.Background(), ep, ollamaTestRequest("llama3", 1, map[string]string{"mode": "shout"}))
+	if err == nil || !strings.Contains(err.Error(), "mode=shout") {
+		t.Errorf("Expected an option error, got %v", err)
+	}
+	_, err = ollamaCompleter{}.Complete(context.Background(), ep, ollamaTestRequest("llama3", 1, map[string]string{"num_ctx": "lots"}))
+	if err == nil || !strings.Contains(err.Error(), "num_ctx=lots") {
+		t.Errorf("Expected a number error, got %v", err)
+	}
+	n := len(requests)
+	_, err = ollamaCompleter{}.Complete(context.Background(), ep, ollamaTestRequest("llama3", 1, map[string]string{"seeed": "3"}))
+	if err == nil || !strings.Contains(err.Error(), "option seeed: not an option of ollama endpoints") || len(requests) != n {
+		t.Errorf("Expected an unknown option error without a request, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/Michael-F-Ellis/goopenai"
+)
+
+// openAIOptions are the AI: line options of OpenAI endpoints.
+var openAIOptions = map[string]optionSpec{
+	"seed":              {"seed", optionInt},
+	"top_p":             {"top_p", optionFloat},
+	"presence_penalty":  {"presence_penalty", optionFloat},
+	"frequency_penalty": {"frequency_penalty", optionFloat},
+	"stop":              {"stop", optionList},
+}
+
+// openAICompleter sends requests to OpenAI's v1/chat/completions endpoint, or
+// to a server that mimics it, with the goopenai client.
+type openAICompleter struct{}
+
+func (openAICompleter) Complete(ctx context.Context, ep *endpoint, req completionRequest) (completion, error) {
+	var result completion
+	apiKey, err := ep.apiKey()
+	if err != nil {
+		return result, err
+	}
+	client := goopenai.NewClient(apiKey, ep.Organization)
+	// Escape special characters in text
+	escapedText, err := json.Marshal(req.Prompt)
+	if err != nil {
+		return result, err
+	}
+	url := ep.URL
+	maxtok, cnt := req.MaxTokens, req.N // the request takes pointers to these
+	r := goopenai.CreateChatCompletionsRequest{
+		Messages: []goopenai.Message{
+			{
+				Role:    "user",
+				Content: string(escapedText),
+			},
+		},
+		Model:       req.Model,
+		Temperature: ep.temperature(req),
+		MaxTokens:   &maxtok,
+		N:           &cnt,
+	}
+	if req.System != "" {
+		r.Messages = append([]goopenai.Message{{Role: "system", Content: req.System}}, r.Messages...)
+	}
+	// Extra information needed for llama.cpp endpoints
+	cache_prompt := false
+	slot_id := 0
+	if ep.LlamaCpp {
+		cache_prompt = true
+		slot_id = slotFor(ep, req.Doc)
+		r.CachePrompt = &cache_prompt
+		r.SlotId = &slot_id
+	}
+
+	body, err := openAIRequestFor(&r, req)
+	if err != nil {
+		return result, err
+	}
+
+	err = withRetries(ctx, func(ctx context.Context) error {
+		var completions *openAIResponse
+		var err error
+		// The goopenai client can't send the extra fields, nor decode
+		// the timings of llama.cpp servers.
+		if body.ResponseFormat != nil || len(body.Extra) > 0 || ep.LlamaCpp {
+			completions, err = openAIPost(ctx, ep, apiKey, body)
+		} else {
+			var c *goopenai.CreateChatCompletionsResponse
+			c, err = client.CreateChatCompletions(ctx, &r, url)
+			if c != nil {
+				completions = &openAIResponse{CreateChatCompletionsResponse: *c}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		/* Response should be like this
+		{
+		  "id": "chatcmpl-xxx",
+		  "object": "chat.completion",
+		  "created": 1678667132,
+		  "model": "gpt-3.5-turbo-0301",
+		  "usage": {
+		    "prompt_tokens": 13,
+		    "completion_tokens": 7,
+		    "total_tokens": 20
+		  },
+		  "choices": [
+		    {
+		      "message": {
+		        "role": "assistant",
+		        "content": "\n\nThis is a test!"
+		      },
+		      "finish_reason": "stop",
+		      "index": 0
+		    }
+		  ]
+		}
+		*/
+		// Log the response token counts
+		pt := completions.Usage.PromptTokens
+		ct := completions.Usage.CompletionTokens
+		tt := completions.Usage.TotalTokens
+		log.Printf("tokens: prompt=%d, completion=%d, total=%d\n", pt, ct, tt)
+		if ep.LlamaCpp {
+			logCacheUse(ep, slot_id, pt, completions.cachedTokens())
+		}
+		result.PromptTokens, result.CompletionTokens = pt, ct
+		result.Choices = result.Choices[:0]
+		for _, c := range completions.Choices {
+			result.Choices = append(result.Choices, c.Message.Content)
+		}
+		return nil
+	})
+	if showJsonReq {
+		jsn, err := json.Marshal(body)
+		if err != nil {
+			log.Print(err)
+		} else {
+			log.Print(string(jsn))
+		}
+	}
+	return result, err
+}
+
+// openAIURL is where requests to OpenAI endpoints without a URL go.
+const openAIURL = "https://api.openai.com/v1/chat/completions"
+
+// openAIRequest is a chat completions request with the fields the goopenai
+// client can't send: a response_format and the AI: line options.
+type openAIRequest struct {
+	*goopenai.CreateChatCompletionsRequest
+	ResponseFormat *openAIResponseFormat  `json:"response_format,omitempty"`
+	Extra          map[string]interface{} `json:"-"`
+}
+
+type openAIResponseFormat struct {
+	Type       string `json:"type"` // json_schema
+	JSONSchema struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+	} `json:"json_schema"`
+}
+
+func (r openAIRequest) MarshalJSON() ([]byte, error) {
+	type plain openAIRequest // without this method
+	return marshalWithExtra(plain(r), r.Extra)
+}
+
+// openAIResponse is a chat completions response, with the timings llama.cpp
+// servers add.
+type openAIResponse struct {
+	goopenai.CreateChatCompletionsResponse
+	Timings *struct {
+		PromptN int `json:"prompt_n"` // prompt tokens not found in the cache
+	} `json:"timings"`
+}
+
+// cachedTokens returns the number of prompt tokens the server took from its
+// cache, or -1 if it didn't report timings.
+func (r openAIResponse) cachedTokens() int {
+	if r.Timings == nil {
+		return -1
+	}
+	return r.Usage.PromptTokens - r.Timings.PromptN
+}
+
+// openAIRequestFor adds req's schema and options to r.
+func openAIRequestFor(r *goopenai.CreateChatCompletionsRequest, req completionRequest) (openAIRequest, error) {
+	body := openAIRequest{CreateChatCompletionsRequest: r, Extra: make(map[string]interface{})}
+	if req.Schema != nil {
+		body.ResponseFormat = &openAIResponseFormat{Type: "json_schema"}
+		body.ResponseFormat.JSONSchema.Name = "document"
+		body.ResponseFormat.JSONSchema.Schema = req.Schema
+	}
+	for k, v := range req.Options {
+		spec, err := lookupOption(providerOpenAI, openAIOptions, k)
+		if err != nil {
+			return body, err
+		}
+		value, err := spec.value(v)
+		if err != nil {
+			return body, fmt.Errorf("option %s=%s: %w", k, v, err)
+		}
+		body.Extra[spec.field] = value
+	}
+	return body, nil
+}
+
+// openAIPost sends body to ep.
+func openAIPost(ctx context.Context, ep *endpoint, apiKey string, body openAIRequest) (*openAIResponse, error) {
+	headers := make(map[string]string)
+	if apiKey != "" {
+		headers["Authorization"] = "Bearer " + apiKey
+	}
+	if ep.Organization != "" {
+		headers["OpenAI-Organization"] = ep.Organization
+	}
+	url := ep.URL
+	if url == "" {
+		url = openAIURL
+	}
+	resp, err := postJSON(ctx, url, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var completions openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completions); err != nil {
+		return nil, err
+	}
+	return &completions, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAICompleter(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		fmt.Fprint(w, `{"choices": [{"message": {"role": "assistant", "content": "Hello there."}}], "usage": {"prompt_tokens": 9, "completion_tokens": 3}}`)
+	}))
+	defer server.Close()
+	ep := &endpoint{Name: "local", URL: server.URL + "/v1/chat/completions", Provider: providerOpenAI}
+
+	req := completionRequest{Model: "gpt-4o", Prompt: "Say hello.", MaxTokens: 50, Temperature: 0.5, N: 1,
+		Options: map[string]string{"stop": "CHAPTER|THE END", "seed": "3", "top_p": "0.9"}}
+	c, err := openAICompleter{}.Complete(context.Background(), ep, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Choices, []string{"Hello there."}) || c.PromptTokens != 9 {
+		t.Errorf("Unexpected completion %+v", c)
+	}
+	body := bodies[0]
+	if stop, _ := json.Marshal(body["stop"]); string(stop) != `["CHAPTER","THE END"]` {
+		t.Errorf("Expected two stop sequences, got %s", stop)
+	}
+	if body["seed"] != float64(3) || body["top_p"] != 0.9 || body["model"] != "gpt-4o" || body["max_tokens"] != float64(50) {
+		t.Errorf("Unexpected request %v", body)
+	}
+
+	tests := []struct {
+		opts          map[string]string
+		expectedError string
+	}{
+		{opts: map[string]string{"seeed": "3"}, expectedError: "option seeed: not an option of openai endpoints"},
+		{opts: map[string]string{"seed": "many"}, expectedError: "option seed=many:"},
+	}
+	for _, tt := range tests {
+		bodies = nil
+		req.Options = tt.opts
+		_, err := openAICompleter{}.Complete(context.Background(), ep, req)
+		if err == nil || !strings.Contains(err.Error(), tt.expectedError) || len(bodies) != 0 {
+			t.Errorf("%v: expected an error containing %q without a request, got %v", tt.opts, tt.expectedError, err)
+		}
+	}
+}
+
+func TestOpenAICompleterCacheUse(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprint(w, `{"choices": [{"message": {"role": "assistant", "content": "Hello there."}}], "usage": {"prompt_tokens": 20, "completion_tokens": 3}, "timings": {"prompt_n": 5}}`)
+	}))
+	defer server.Close()
+	ep := &endpoint{Name: "openai-cache-test", URL: server.URL + "/v1/chat/completions", Provider: providerOpenAI, LlamaCpp: true}
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+	req := completionRequest{Model: "llama3", Prompt: "Say hello.", MaxTokens: 50, Temperature: 0.5, N: 1, Doc: "story.ait"}
+	if _, err := (openAICompleter{}).Complete(context.Background(), ep, req); err != nil {
+		t.Fatal(err)
+	}
+	if body["cache_prompt"] != true {
+		t.Errorf("Expected prompt caching to be asked for, got %v", body)
+	}
+	if !strings.Contains(logged.String(), "15 of 20 prompt tokens cached") {
+		t.Errorf("Expected the cache use to be logged, got %q", logged.String())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// Each provider knows the AI: line options its completer sends and the type
+// of their values. Anything else is an error before a request is made, rather
+// than a body field that the server ignores or rejects.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// optionKind is the type of an option's value.
+type optionKind int
+
+const (
+	optionString optionKind = iota
+	optionInt
+	optionFloat
+	optionBool
+	optionList // separated by '|', since commas separate AI: line fields
+)
+
+// optionSpec describes an option a provider takes: the field it is sent as
+// and the type of its value.
+type optionSpec struct {
+	field string
+	kind  optionKind
+}
+
+// value returns v, the option's value on the AI: line, as the type it is
+// sent as.
+func (s optionSpec) value(v string) (interface{}, error) {
+	switch s.kind {
+	case optionInt:
+		n, err := strconv.Atoi(v)
+		return n, err
+	case optionFloat:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err
+	case optionBool:
+		b, err := strconv.ParseBool(v)
+		return b, err
+	case optionList:
+		return strings.Split(v, "|"), nil
+	}
+	return v, nil
+}
+
+// lookupOption returns the spec of the option key in options, the options of
+// provider, or an error naming the options there are.
+func lookupOption(provider string, options map[string]optionSpec, key string) (optionSpec, error) {
+	spec, ok := options[key]
+	if !ok {
+		return spec, fmt.Errorf("option %s: not an option of %s endpoints, use %s", key, provider, strings.Join(sortedKeys(options), ", "))
+	}
+	return spec, nil
+}
+
+// marshalWithExtra returns the JSON of v, a struct, with the fields of extra
+// added, for request bodies that carry options as fields of their own.
+func marshalWithExtra(v interface{}, extra map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		m[k] = v
+	}
+	return json.Marshal(m)
+}
+
+// generalOptions are the AI: line options ficta handles itself, whatever the
+// provider.
+var generalOptions = []string{"system", rawTempOption, "cache"}
+
+// providerOptions holds the options of each provider.
+var providerOptions = map[string]map[string]optionSpec{
+	providerOpenAI:    openAIOptions,
+	providerOllama:    ollamaOptions,
+	providerLlamaCpp:  llamaCppOptions,
+	providerAnthropic: anthropicOptions,
+	providerGemini:    geminiOptions,
+}
+
+// knownOption reports whether key is an option of any provider.
+func knownOption(key string) bool {
+	if contains(generalOptions, key) {
+		return true
+	}
+	for _, options := range providerOptions {
+		if _, ok := options[key]; ok {
+			return true
+		}
+	}
+	return false
+}
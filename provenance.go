@@ -0,0 +1,264 @@
+package main
+
+// Publishers may require disclosure of text written by a model, which after a
+// few rounds of editing can't be told apart from the author's. With -pv,
+// every response is written between provenance markers naming the model and
+// the time, either as comments or as invisible characters, and
+// "ficta provenance" reports how much of each document came from models.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Provenance modes, set with -pv.
+const (
+	provenanceOff       = "off"       // no markers
+	provenanceComment   = "comment"   // markers are author comments
+	provenanceInvisible = "invisible" // markers are invisible Unicode tag characters
+)
+
+var provenanceMode string // the -pv mode
+
+// Marker texts. A begin marker is followed by the model and the time.
+const (
+	provenanceBegin = "ficta-ai-begin"
+	provenanceEnd   = "ficta-ai-end"
+)
+
+// Invisible markers are written in the Unicode tag characters, which mirror
+// printable ASCII and are not displayed, between a begin tag and a cancel
+// tag.
+const (
+	tagBegin  = '\U000E0001'
+	tagCancel = '\U000E007F'
+	tagOffset = 0xE0000
+)
+
+// markProvenance returns response s from model wrapped in provenance markers
+// in the current mode, comments being in the syntax syn.
+func markProvenance(s, model string, at time.Time, syn commentSyntax) string {
+	begin := fmt.Sprintf("%s %s %s", provenanceBegin, model, at.UTC().Format(time.RFC3339))
+	switch provenanceMode {
+	case provenanceComment:
+		return syn.comment(begin) + "\n" + s + "\n" + syn.comment(provenanceEnd)
+	case provenanceInvisible:
+		return invisible(begin) + s + invisible(provenanceEnd)
+	}
+	return s
+}
+
+// invisible encodes s, which must be printable ASCII, as tag characters.
+func invisible(s string) string {
+	var b strings.Builder
+	b.WriteRune(tagBegin)
+	for _, r := range s {
+		b.WriteRune(tagOffset + r)
+	}
+	b.WriteRune(tagCancel)
+	return b.String()
+}
+
+// removeInvisibleMarkers removes invisible provenance markers from text,
+// which are never part of a prompt. Other tag characters, which are part of
+// some emoji, are left alone.
+func removeInvisibleMarkers(text string) string {
+	for {
+		i := strings.IndexRune(text, tagBegin)
+		if i < 0 {
+			return text
+		}
+		n := len(string(tagBegin))
+		if j := strings.IndexRune(text[i:], tagCancel); j >= 0 {
+			n = j + len(string(tagCancel))
+		}
+		text = text[:i] + text[i+n:]
+	}
+}
+
+// provenanceSpan is a part of a document written by the author or, if model
+// is set, by a model.
+type provenanceSpan struct {
+	text  string
+	model string
+}
+
+// splitProvenance splits text, written in the comment syntax syn, at its
+// provenance markers of either kind. A response whose end marker is missing
+// runs to the end of the text.
+func splitProvenance(text string, syn commentSyntax) []provenanceSpan {
+	var (
+		spans   []provenanceSpan
+		current provenanceSpan
+		b       strings.Builder
+	)
+	flush := func(next provenanceSpan) {
+		current.text = b.String()
+		if current.text != "" || current.model != "" {
+			spans = append(spans, current)
+		}
+		b.Reset()
+		current = next
+	}
+	marker := func(fields []string) {
+		switch {
+		case len(fields) > 0 && fields[0] == provenanceEnd:
+			flush(provenanceSpan{})
+		case len(fields) > 0 && fields[0] == provenanceBegin:
+			next := provenanceSpan{model: "unknown"}
+			if len(fields) > 1 {
+				next.model = fields[1]
+			}
+			flush(next)
+		}
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if fields, ok := commentMarker(line, syn); ok {
+			marker(fields)
+			continue
+		}
+		for len(line) > 0 {
+			i := strings.IndexRune(line, tagBegin)
+			if i < 0 {
+				b.WriteString(line)
+				break
+			}
+			b.WriteString(line[:i])
+			line = line[i+len(string(tagBegin)):]
+			j := strings.IndexRune(line, tagCancel)
+			if j < 0 {
+				j = len(line)
+			}
+			marker(strings.Fields(strings.Map(func(r rune) rune { return r - tagOffset }, line[:j])))
+			line = strings.TrimPrefix(line[j:], string(tagCancel))
+		}
+	}
+	flush(provenanceSpan{})
+	return spans
+}
+
+// commentMarker returns the fields of the provenance marker comment on line,
+// if it is one.
+func commentMarker(line string, syn commentSyntax) ([]string, bool) {
+	trimmed := strings.TrimSpace(line)
+	start := syn.Line
+	if start == "" {
+		start = syn.BlockPrefix
+		trimmed = strings.TrimSuffix(trimmed, syn.BlockSuffix)
+	}
+	body, ok := strings.CutPrefix(trimmed, start)
+	if start == "" || !ok {
+		return nil, false
+	}
+	fields := strings.Fields(body)
+	if len(fields) == 0 || (fields[0] != provenanceBegin && fields[0] != provenanceEnd) {
+		return nil, false
+	}
+	return fields, true
+}
+
+// provenanceCounts are the characters, and words, of a document by who
+// wrote them.
+type provenanceCounts struct {
+	Human      int            `json:"human"`
+	AI         int            `json:"ai"`
+	HumanWords int            `json:"human_words"`
+	AIWords    int            `json:"ai_words"`
+	Responses  int            `json:"responses"`
+	ByModel    map[string]int `json:"by_model"`
+}
+
+// countProvenance counts the characters of text, the contents of the
+// document filename, written by the author and by models. Comments, AI:
+// lines and white space don't count.
+func countProvenance(text, filename string) (provenanceCounts, error) {
+	c := provenanceCounts{ByModel: make(map[string]int)}
+	syn, err := commentSyntaxFor(filename, text)
+	if err != nil {
+		return c, err
+	}
+	for _, span := range splitProvenance(removeModeline(removeFrontMatter(text)), syn) {
+		stripped, _ := stripComments(span.text, syn)
+		n, words := 0, 0
+		for _, line := range strings.Split(stripped, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "AI:") {
+				continue
+			}
+			words += len(strings.Fields(line))
+			for _, r := range line {
+				if !unicode.IsSpace(r) {
+					n++
+				}
+			}
+		}
+		if span.model == "" {
+			c.Human += n
+			c.HumanWords += words
+			continue
+		}
+		c.AI += n
+		c.AIWords += words
+		c.Responses++
+		c.ByModel[span.model] += n
+	}
+	return c, nil
+}
+
+// percent returns n as a percentage of total.
+func percent(n, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return (100*n + total/2) / total
+}
+
+// runProvenance implements the provenance subcommand:
+//
+//	ficta provenance file [file ...]
+//
+// For each document it prints the number of characters written by the author
+// and by each model, according to the document's provenance markers.
+func runProvenance(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ficta provenance file [file ...]")
+	}
+	var failed error
+	for _, filename := range args {
+		text, err := os.ReadFile(filename)
+		if err == nil {
+			var c provenanceCounts
+			c, err = countProvenance(string(text), filename)
+			if err == nil {
+				printProvenance(filename, c)
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+		failed = errors.New("provenance: some files could not be read")
+	}
+	return failed
+}
+
+func printProvenance(filename string, c provenanceCounts) {
+	total := c.Human + c.AI
+	fmt.Printf("%s: %d characters, human %d (%d%%), AI %d (%d%%) in %d responses\n",
+		filename, total, c.Human, percent(c.Human, total), c.AI, percent(c.AI, total), c.Responses)
+	models := make([]string, 0, len(c.ByModel))
+	for m := range c.ByModel {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		if c.ByModel[models[i]] != c.ByModel[models[j]] {
+			return c.ByModel[models[i]] > c.ByModel[models[j]]
+		}
+		return models[i] < models[j]
+	})
+	for _, m := range models {
+		fmt.Printf("   %-30s %d (%d%%)\n", m, c.ByModel[m], percent(c.ByModel[m], total))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarkProvenance(t *testing.T) {
+	defer func(mode string) { provenanceMode = mode }(provenanceMode)
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		mode     string
+		syntax   commentSyntax
+		expected string
+	}{
+		{mode: provenanceOff, syntax: commentProfiles["c"], expected: "The fox ran."},
+		{mode: provenanceComment, syntax: commentProfiles["c"], expected: "// ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z\nThe fox ran.\n// ficta-ai-end"},
+		{mode: provenanceComment, syntax: commentProfiles["html"], expected: "<!-- ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z -->\nThe fox ran.\n<!-- ficta-ai-end -->"},
+		{mode: provenanceInvisible, syntax: commentProfiles["c"], expected: invisible("ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z") + "The fox ran." + invisible("ficta-ai-end")},
+	}
+	for _, tt := range tests {
+		provenanceMode = tt.mode
+		if got := markProvenance("The fox ran.", "gpt-4o", at, tt.syntax); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.mode, tt.expected, got)
+		}
+	}
+	if got := invisible("ai"); got != "\U000E0001\U000E0061\U000E0069\U000E007F" {
+		t.Errorf("Unexpected invisible encoding %q", got)
+	}
+}
+
+func TestRemoveInvisibleMarkers(t *testing.T) {
+	england := "\U0001F3F4\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F"
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{text: "Plain text", expected: "Plain text"},
+		{text: invisible("ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z") + "The fox ran." + invisible("ficta-ai-end"), expected: "The fox ran."},
+		{text: "Go " + england + "!", expected: "Go " + england + "!"},
+		{text: "Cut \U000E0001off", expected: "Cut off"},
+	}
+	for _, tt := range tests {
+		if got := removeInvisibleMarkers(tt.text); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.text, tt.expected, got)
+		}
+	}
+}
+
+func TestCountProvenance(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	tests := []struct {
+		name     string
+		filename string
+		text     string
+		expected provenanceCounts
+	}{
+		{
+			name:     "No markers",
+			filename: "story.txt",
+			text:     "Once upon a time\n// a note\n\nAI: gpt-4o, 100, 0.700, 1",
+			expected: provenanceCounts{Human: 13, ByModel: map[string]int{}},
+		},
+		{
+			name:     "Comment markers",
+			filename: "story.txt",
+			text: "Once upon a time\n\n// ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z\nThe fox ran.\n// ficta-ai-end\n\nThen\n\n" +
+				"// response 1 of 2\n\n// ficta-ai-begin gpt-4o-mini 2024-05-01T12:31:00Z\nAway\n// ficta-ai-end\n\n" +
+				"// response 2 of 2\n\n// ficta-ai-begin gpt-4o-mini 2024-05-01T12:31:00Z\nHome\n// ficta-ai-end\n\nAI: gpt-4o, 100, 0.700, 1",
+			expected: provenanceCounts{Human: 17, AI: 18, Responses: 3, ByModel: map[string]int{"gpt-4o": 10, "gpt-4o-mini": 8}},
+		},
+		{
+			name:     "HTML comment markers",
+			filename: "story.md",
+			text:     "# Title\n\n<!-- ficta-ai-begin gemini:gemini-1.5-pro 2024-05-01T12:30:00Z -->\nThe fox ran.\n<!-- ficta-ai-end -->\n",
+			expected: provenanceCounts{Human: 6, AI: 10, Responses: 1, ByModel: map[string]int{"gemini:gemini-1.5-pro": 10}},
+		},
+		{
+			name:     "Invisible markers",
+			filename: "story.txt",
+			text:     "Once upon a time " + invisible("ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z") + "the fox ran." + invisible("ficta-ai-end") + " The end.",
+			expected: provenanceCounts{Human: 20, AI: 10, Responses: 1, ByModel: map[string]int{"gpt-4o": 10}},
+		},
+		{
+			name:     "Missing end marker",
+			filename: "story.txt",
+			text:     "Once\n// ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z\nThe fox ran.",
+			expected: provenanceCounts{Human: 4, AI: 10, Responses: 1, ByModel: map[string]int{"gpt-4o": 10}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := countProvenance(tt.text, tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Human != tt.expected.Human || c.AI != tt.expected.AI || c.Responses != tt.expected.Responses || len(c.ByModel) != len(tt.expected.ByModel) {
+				t.Fatalf("Expected %+v, got %+v", tt.expected, c)
+			}
+			for m, n := range tt.expected.ByModel {
+				if c.ByModel[m] != n {
+					t.Errorf("Expected %d characters from %s, got %d", n, m, c.ByModel[m])
+				}
+			}
+		})
+	}
+}
+
+func TestCompleteTextProvenance(t *testing.T) {
+	defer func(mode string) { provenanceMode = mode }(provenanceMode)
+	provenanceMode = provenanceInvisible
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+	text := "Once upon a time\n\nAI: gpt-4o, 100, 0.700, 1"
+	got, _, err := completeText(text, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := invisible("ficta-ai-begin gpt-4o ")
+	if !strings.Contains(got, begin[:len(begin)-len(string(tagCancel))]) || !strings.Contains(got, "It was a dark night."+invisible("ficta-ai-end")+"\n\nAI:") {
+		t.Errorf("Expected the response to be marked, got %q", got)
+	}
+	// The markers are not sent with the next request.
+	if _, _, err := completeText(got, ""); err != nil {
+		t.Fatal(err)
+	}
+	if prompt := f.requests[1].Prompt; prompt != "Once upon a time\n\nIt was a dark night.\n\n" {
+		t.Errorf("Expected a prompt without markers, got %q", prompt)
+	}
+}
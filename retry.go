@@ -0,0 +1,206 @@
+package main
+
+// Completion requests fail for all sorts of transient reasons: rate limits,
+// overloaded servers, dropped connections. This file retries those with
+// jittered exponential backoff and, when a request finally fails, writes the
+// error into the document where the author will see it.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	maxRetries     int           // number of retries after the first attempt
+	requestTimeout time.Duration // time limit for each attempt, 0 for none
+)
+
+const (
+	retryBaseDelay = time.Second      // delay before the first retry
+	retryMaxDelay  = 30 * time.Second // cap on the exponential backoff
+	retryMaxWait   = 2 * time.Minute  // longest Retry-After we are willing to wait
+
+	// errorAnnotationTag marks the comments annotateText writes so that they
+	// can be found and removed again.
+	errorAnnotationTag = "ficta error:"
+)
+
+// sleep is time.Sleep, replaced in tests.
+var sleep = time.Sleep
+
+// statusError is an HTTP error status returned by a completion endpoint.
+type statusError struct {
+	StatusCode int
+	RetryAfter time.Duration // from the Retry-After header, 0 if absent
+	Message    string
+}
+
+func (e *statusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// withRetries calls send until it succeeds, fails with an error that isn't
+// worth retrying, has been retried maxRetries times or parent is done. Each
+// call gets its own context, derived from parent and limited by
+// requestTimeout.
+func withRetries(parent context.Context, send func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := parent, context.CancelFunc(func() {})
+		if requestTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		}
+		err := send(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		retry, retryAfter := retryable(err)
+		if !retry || attempt >= maxRetries || parent.Err() != nil {
+			if attempt > 0 {
+				return fmt.Errorf("%w (after %d attempts)", err, attempt+1)
+			}
+			return err
+		}
+		if retryAfter > retryMaxWait {
+			return fmt.Errorf("%w (server asked us to wait %v)", err, retryAfter)
+		}
+		delay := backoff(attempt, retryAfter)
+		log.Printf("request failed: %v; retrying in %v", err, delay.Round(time.Millisecond))
+		sleep(delay)
+	}
+}
+
+// backoff returns the delay before retry number attempt+1: an exponentially
+// growing delay with random jitter, but never less than the server's
+// Retry-After.
+func backoff(attempt int, retryAfter time.Duration) time.Duration {
+	d := retryBaseDelay << attempt
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	if retryAfter > d {
+		d = retryAfter
+	}
+	return d
+}
+
+var (
+	// transientStatus finds HTTP status codes worth retrying in error text.
+	transientStatus = regexp.MustCompile(`\b(429|5\d\d)\b`)
+	// tryAgainIn finds the wait that OpenAI suggests in rate limit messages,
+	// e.g. "Please try again in 20s" or "in 350ms".
+	tryAgainIn = regexp.MustCompile(`try again in ([0-9.]+)(ms|s)\b`)
+)
+
+// retryable reports whether err is worth retrying and how long the server
+// asked us to wait, if it said.
+func retryable(err error) (bool, time.Duration) {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests || se.StatusCode >= 500, se.RetryAfter
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true, 0
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true, 0
+	}
+	// Errors from the goopenai client are plain text, so look for the usual
+	// suspects in the message.
+	msg := strings.ToLower(err.Error())
+	var after time.Duration
+	if m := tryAgainIn.FindStringSubmatch(msg); m != nil {
+		if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+			after = time.Duration(v * float64(time.Second))
+			if m[2] == "ms" {
+				after /= 1000
+			}
+		}
+	}
+	if transientStatus.MatchString(msg) {
+		return true, after
+	}
+	for _, s := range []string{"rate limit", "overloaded", "timeout", "connection refused", "connection reset", "eof"} {
+		if strings.Contains(msg, s) {
+			return true, after
+		}
+	}
+	return false, 0
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date. It returns 0 if h is empty or invalid.
+func parseRetryAfter(h string) time.Duration {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// annotateFile records err as an author comment in filename, just above its
+// AI: line. Being a comment, the note is excluded from the next prompt.
+func annotateFile(filename string, err error) error {
+	text, rerr := os.ReadFile(filename)
+	if rerr != nil {
+		return rerr
+	}
+	// An unknown modeline profile may be the error, so the note falls back
+	// to the default syntax.
+	syn, _ := commentSyntaxFor(filename, string(text))
+	return overwriteFile(filename, "", annotateText(string(text), syn, err))
+}
+
+// annotateText inserts a comment describing err above the last AI: line of
+// text, or at the end if there is none, in the comment syntax syn. Notes
+// from earlier failures are replaced.
+func annotateText(text string, syn commentSyntax, err error) string {
+	text = removeErrorAnnotations(text, syn)
+	note := syn.comment(errorAnnotationTag+" "+strings.Join(strings.Fields(err.Error()), " ")) + "\n"
+	part1, aiLine := findLastAILine(text)
+	if aiLine == "" {
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		return text + note
+	}
+	return part1 + note + text[len(part1):]
+}
+
+// removeErrorAnnotations removes the notes annotateText wrote in the comment
+// syntax syn.
+func removeErrorAnnotations(text string, syn commentSyntax) string {
+	prefix, _, _ := strings.Cut(syn.comment(errorAnnotationTag), errorAnnotationTag)
+	prefix += errorAnnotationTag
+	lines := strings.SplitAfter(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWithRetries(t *testing.T) {
+	defer func(r int, s func(time.Duration)) { maxRetries, sleep = r, s }(maxRetries, sleep)
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	maxRetries = 2
+
+	tests := []struct {
+		name             string
+		errs             []error // returned by successive attempts, then nil
+		expectedAttempts int
+		expectErr        bool
+	}{
+		{name: "Success", expectedAttempts: 1},
+		{name: "Retry then success", errs: []error{&statusError{StatusCode: 503}}, expectedAttempts: 2},
+		{name: "Gives up", errs: []error{&statusError{StatusCode: 500}, &statusError{StatusCode: 502}, &statusError{StatusCode: 504}}, expectedAttempts: 3, expectErr: true},
+		{name: "Not retryable", errs: []error{&statusError{StatusCode: 400}}, expectedAttempts: 1, expectErr: true},
+		{name: "Rate limit text", errs: []error{errors.New("Rate limit reached. Please try again in 20ms.")}, expectedAttempts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := withRetries(context.Background(), func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tt.expectedAttempts {
+				t.Errorf("Expected %d attempts, got %d", tt.expectedAttempts, attempts)
+			}
+			if (err != nil) != tt.expectErr {
+				t.Errorf("Unexpected error result: %v", err)
+			}
+		})
+	}
+
+	slept = nil
+	_ = withRetries(context.Background(), func(ctx context.Context) error {
+		if len(slept) == 0 {
+			return &statusError{StatusCode: 429, RetryAfter: 45 * time.Second}
+		}
+		return nil
+	})
+	if len(slept) != 1 || slept[0] != 45*time.Second {
+		t.Errorf("Expected to honor Retry-After, slept %v", slept)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := backoff(attempt, 0)
+		if d < retryBaseDelay/2 || d > retryMaxDelay {
+			t.Errorf("backoff(%d) = %v out of range", attempt, d)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("7"); d != 7*time.Second {
+		t.Errorf("Expected 7s, got %v", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d < 59*time.Minute {
+		t.Errorf("Expected about an hour, got %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("Expected 0, got %v", d)
+	}
+}
+
+func TestAnnotateText(t *testing.T) {
+	tests := []struct {
+		syntax    commentSyntax
+		expected1 string
+		expected2 string
+	}{
+		{
+			syntax:    commentProfiles["c"],
+			expected1: "Once upon a time.\n\n// ficta error: 503 Service Unavailable\nAI: gpt-4, 100, 0.7, 1",
+			expected2: "Once upon a time.\n\n// ficta error: timeout\nAI: gpt-4, 100, 0.7, 1",
+		},
+		{
+			syntax:    commentProfiles["html"],
+			expected1: "Once upon a time.\n\n<!-- ficta error: 503 Service Unavailable -->\nAI: gpt-4, 100, 0.7, 1",
+			expected2: "Once upon a time.\n\n<!-- ficta error: timeout -->\nAI: gpt-4, 100, 0.7, 1",
+		},
+	}
+	text := "Once upon a time.\n\nAI: gpt-4, 100, 0.7, 1"
+	for _, tt := range tests {
+		annotated := annotateText(text, tt.syntax, errors.New("503 Service\nUnavailable"))
+		if annotated != tt.expected1 {
+			t.Errorf("Expected %q, got %q", tt.expected1, annotated)
+		}
+		// A second failure replaces the first note.
+		annotated = annotateText(annotated, tt.syntax, errors.New("timeout"))
+		if annotated != tt.expected2 {
+			t.Errorf("Expected %q, got %q", tt.expected2, annotated)
+		}
+		if removeErrorAnnotations(annotated, tt.syntax) != text {
+			t.Errorf("Expected the note to be removed, got %q", removeErrorAnnotations(annotated, tt.syntax))
+		}
+		if got, _ := stripComments(annotated, tt.syntax); got != "Once upon a time.\n\nAI: gpt-4, 100, 0.7, 1" {
+			t.Errorf("Expected the note to be excluded from the prompt, got %q", got)
+		}
+	}
+}
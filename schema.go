@@ -0,0 +1,422 @@
+package main
+
+// Documents whose responses are parsed by other programs, such as outlines,
+// character sheets and metadata, can declare a JSON schema. It is sent to
+// the servers that can constrain their output with one and every response is
+// checked against it before it is written.
+//
+// The schema is given by a line of the prompt text,
+//
+//	@SCHEMA outline.json
+//
+// naming a file relative to the document, or inline, between a line holding
+// only @SCHEMA and a line holding only @END. Either way it is not sent as
+// part of the prompt.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	schemaDirective = "@SCHEMA"
+	schemaEnd       = "@END"
+)
+
+// jsonSchema is the part of JSON Schema that ficta checks responses against
+// and turns into grammars. Other keywords are accepted and ignored.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"` // false forbids other properties
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Const                json.RawMessage        `json:"const"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+// schemaTypes is the type keyword, which may be a name or a list of names.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		*t = schemaTypes{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return errors.New("type must be a name or a list of names")
+	}
+	*t = names
+	return nil
+}
+
+// types returns the types s allows, inferring object or array from the
+// keywords when there is no type keyword. None means any type.
+func (s *jsonSchema) types() []string {
+	switch {
+	case len(s.Type) > 0:
+		return s.Type
+	case s.Properties != nil:
+		return []string{"object"}
+	case s.Items != nil:
+		return []string{"array"}
+	}
+	return nil
+}
+
+// parseSchema decodes a schema and checks its types.
+func parseSchema(data []byte) (*jsonSchema, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, s.check("$")
+}
+
+func (s *jsonSchema) check(path string) error {
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("%s: unknown type %q", path, t)
+		}
+	}
+	for _, name := range sortedKeys(s.Properties) {
+		if err := s.Properties[name].check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check(path + "[]")
+	}
+	return nil
+}
+
+// extractSchema removes the @SCHEMA line or block from prompt and returns
+// what remains along with the schema, nil if there is none. File names are
+// resolved against dir.
+func extractSchema(prompt, dir string) (string, json.RawMessage, error) {
+	var (
+		kept   []string
+		schema []byte
+		inline []string
+		inside bool
+	)
+	for _, line := range strings.Split(prompt, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case inside && trimmed == schemaEnd:
+			inside = false
+			schema = []byte(strings.Join(inline, "\n"))
+		case inside:
+			inline = append(inline, line)
+		case trimmed == schemaDirective || strings.HasPrefix(trimmed, schemaDirective+" "):
+			if schema != nil {
+				return prompt, nil, fmt.Errorf("%s: only one schema is allowed", schemaDirective)
+			}
+			path := strings.TrimSpace(strings.TrimPrefix(trimmed, schemaDirective))
+			if path == "" {
+				inside = true
+				continue
+			}
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return prompt, nil, fmt.Errorf("%s: %w", schemaDirective, err)
+			}
+			schema = data
+		default:
+			kept = append(kept, line)
+		}
+	}
+	if inside {
+		return prompt, nil, fmt.Errorf("%s: no %s line after the inline schema", schemaDirective, schemaEnd)
+	}
+	if schema == nil {
+		return prompt, nil, nil
+	}
+	if _, err := parseSchema(schema); err != nil {
+		return prompt, nil, fmt.Errorf("%s: invalid schema: %w", schemaDirective, err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, schema); err != nil {
+		return prompt, nil, fmt.Errorf("%s: invalid schema: %w", schemaDirective, err)
+	}
+	return strings.Join(kept, "\n"), compact.Bytes(), nil
+}
+
+// checkStructured checks a response against schema and returns the JSON it
+// holds. Models sometimes wrap JSON in a Markdown code fence, which is
+// removed.
+func checkStructured(response string, schema json.RawMessage) (string, error) {
+	s, err := parseSchema(schema)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(response)
+	if strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") {
+		text = strings.TrimSuffix(text, "```")
+		if i := strings.Index(text, "\n"); i >= 0 {
+			text = strings.TrimSpace(text[i+1:])
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return "", fmt.Errorf("the response is not valid JSON: %w", err)
+	}
+	if err := s.validate(v, "$"); err != nil {
+		return "", fmt.Errorf("the response does not match the schema: %w", err)
+	}
+	return text, nil
+}
+
+// validate checks v, a decoded JSON value at path, against s.
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	if types := s.types(); len(types) > 0 {
+		t := jsonType(v)
+		if !contains(types, t) && !(t == "integer" && contains(types, "number")) {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), t)
+		}
+	}
+	if s.Const != nil {
+		var c interface{}
+		json.Unmarshal(s.Const, &c)
+		if !jsonEqual(v, c) {
+			return fmt.Errorf("%s: must be %s", path, s.Const)
+		}
+	}
+	if s.Enum != nil {
+		found := false
+		for _, e := range s.Enum {
+			found = found || jsonEqual(v, e)
+		}
+		if !found {
+			return fmt.Errorf("%s: %s is not one of the allowed values", path, jsonText(v))
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing property %q", path, name)
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			ps, ok := s.Properties[name]
+			if !ok {
+				if string(s.AdditionalProperties) == "false" {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := ps.validate(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: at least %d items expected, got %d", path, *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: at most %d items expected, got %d", path, *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: at least %d characters expected, got %d", path, *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: at most %d characters expected, got %d", path, *s.MaxLength, n)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %v is less than the minimum of %v", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %v is more than the maximum of %v", path, v, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+// jsonType returns the schema type name of a decoded JSON value.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func jsonText(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return jsonText(a) == jsonText(b)
+}
+
+// sortedKeys returns the keys of m in order, so that errors and grammars
+// don't depend on map iteration.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// gbnfRules are the rules for JSON values that schema grammars build on.
+const gbnfRules = `ws ::= [ \t\n]*
+value ::= object | array | string | number | boolean | null
+object ::= "{" ws ( string ":" ws value ( "," ws string ":" ws value )* )? "}" ws
+array ::= "[" ws ( value ( "," ws value )* )? "]" ws
+string ::= "\"" ( [^"\\\x7F\x00-\x1F] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] ) )* "\"" ws
+number ::= integer ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )? ws
+integer ::= "-"? ( [0-9] | [1-9] [0-9]* ) ws
+boolean ::= ( "true" | "false" ) ws
+null ::= "null" ws
+`
+
+// schemaGrammar returns a llama.cpp GBNF grammar for JSON values matching
+// the schema. The properties of an object are generated in alphabetical
+// order, all of them, required or not. Lengths and ranges are left to
+// checkStructured.
+func schemaGrammar(schema json.RawMessage) (string, error) {
+	s, err := parseSchema(schema)
+	if err != nil {
+		return "", err
+	}
+	g := &grammar{names: make(map[string]bool)}
+	root := g.rule("root", s)
+	if root != "root" {
+		g.rules = append([]string{"root ::= " + root}, g.rules...)
+	}
+	return strings.Join(g.rules, "\n") + "\n" + gbnfRules, nil
+}
+
+// grammar collects the rules of a schema grammar.
+type grammar struct {
+	rules []string
+	names map[string]bool
+}
+
+// rule returns the GBNF expression for s, adding a rule called name, or a
+// variant of it, if s needs one.
+func (g *grammar) rule(name string, s *jsonSchema) string {
+	var alts []string
+	if s.Const != nil || s.Enum != nil {
+		if s.Const != nil {
+			alts = append(alts, gbnfLiteral(string(s.Const)))
+		}
+		for _, e := range s.Enum {
+			alts = append(alts, gbnfLiteral(jsonText(e)))
+		}
+		return g.add(name, fmt.Sprintf("( %s ) ws", strings.Join(alts, " | ")))
+	}
+	types := s.types()
+	if len(types) == 0 {
+		return "value"
+	}
+	for _, t := range types {
+		switch {
+		case t == "object" && s.Properties != nil:
+			alts = append(alts, g.object(name, s))
+		case t == "array" && s.Items != nil:
+			item := g.rule(name+"-item", s.Items)
+			list := item + ` ( "," ws ` + item + ` )*`
+			if s.MinItems == nil || *s.MinItems == 0 {
+				list = "( " + list + " )?"
+			}
+			alts = append(alts, `"[" ws `+list+` "]" ws`)
+		default:
+			alts = append(alts, t)
+		}
+	}
+	if len(alts) == 1 && !strings.Contains(alts[0], " ") {
+		return alts[0]
+	}
+	return g.add(name, strings.Join(alts, " | "))
+}
+
+// add adds a rule with an unused name based on name and returns the name.
+func (g *grammar) add(name, expr string) string {
+	unique := name
+	for i := 2; g.names[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	g.names[unique] = true
+	g.rules = append(g.rules, unique+" ::= "+expr)
+	return unique
+}
+
+// object returns the GBNF expression for an object with s's properties.
+func (g *grammar) object(name string, s *jsonSchema) string {
+	var b strings.Builder
+	b.WriteString(`"{" ws`)
+	for i, key := range sortedKeys(s.Properties) {
+		if i > 0 {
+			b.WriteString(` "," ws`)
+		}
+		fmt.Fprintf(&b, " %s ws \":\" ws %s", gbnfLiteral(jsonText(key)), g.rule(name+"-"+ruleName(key), s.Properties[key]))
+	}
+	b.WriteString(` "}" ws`)
+	return b.String()
+}
+
+// ruleName turns a property name into letters, digits and dashes.
+func ruleName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, key)
+	if name == "" {
+		return "property"
+	}
+	return name
+}
+
+// gbnfLiteral quotes s as a GBNF string literal.
+func gbnfLiteral(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Michael-F-Ellis/goopenai"
+)
+
+const characterSchema = `{
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "age": {"type": "integer", "minimum": 0},
+    "role": {"enum": ["hero", "villain"]},
+    "traits": {"type": "array", "items": {"type": "string"}, "maxItems": 3}
+  },
+  "required": ["name", "role"],
+  "additionalProperties": false
+}`
+
+func TestExtractSchema(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "character.json"), []byte(characterSchema), 0644)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"type": "thing"}`), 0644)
+	tests := []struct {
+		prompt         string
+		expectedPrompt string
+		expectedSchema string
+		expectedError  string
+	}{
+		{prompt: "Describe the hero.", expectedPrompt: "Describe the hero."},
+		{prompt: "@SCHEMA character.json\nDescribe the hero.", expectedPrompt: "Describe the hero.", expectedSchema: "character"},
+		{prompt: "Describe the hero.\n@SCHEMA\n{\"type\": \"array\",\n \"items\": {\"type\": \"string\"}}\n@END\nAs a list.", expectedPrompt: "Describe the hero.\nAs a list.", expectedSchema: `{"type":"array","items":{"type":"string"}}`},
+		{prompt: "@SCHEMAS are fun", expectedPrompt: "@SCHEMAS are fun"},
+		{prompt: "@SCHEMA\n{}", expectedError: "no @END line"},
+		{prompt: "@SCHEMA missing.json", expectedError: "no such file"},
+		{prompt: "@SCHEMA broken.json", expectedError: `$: unknown type "thing"`},
+		{prompt: "@SCHEMA\n{\"type\":\n@END", expectedError: "invalid schema"},
+		{prompt: "@SCHEMA character.json\n@SCHEMA character.json", expectedError: "only one schema"},
+	}
+	for _, tt := range tests {
+		prompt, schema, err := extractSchema(tt.prompt, dir)
+		if tt.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("%q: expected an error containing %q, got %v", tt.prompt, tt.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.prompt, err)
+			continue
+		}
+		if prompt != tt.expectedPrompt {
+			t.Errorf("%q: expected prompt %q, got %q", tt.prompt, tt.expectedPrompt, prompt)
+		}
+		switch tt.expectedSchema {
+		case "":
+			if schema != nil {
+				t.Errorf("%q: expected no schema, got %s", tt.prompt, schema)
+			}
+		case "character":
+			if !strings.HasPrefix(string(schema), `{"type":"object","properties":{"name"`) {
+				t.Errorf("%q: expected the compacted character schema, got %s", tt.prompt, schema)
+			}
+		default:
+			if string(schema) != tt.expectedSchema {
+				t.Errorf("%q: expected schema %s, got %s", tt.prompt, tt.expectedSchema, schema)
+			}
+		}
+	}
+}
+
+func TestCheckStructured(t *testing.T) {
+	tests := []struct {
+		response      string
+		expected      string
+		expectedError string
+	}{
+		{response: `{"name": "Ada", "role": "hero"}`, expected: `{"name": "Ada", "role": "hero"}`},
+		{response: "```json\n{\"name\": \"Ada\", \"role\": \"hero\", \"age\": 36}\n```", expected: `{"name": "Ada", "role": "hero", "age": 36}`},
+		{response: `{"name": "Ada", "role": "hero", "traits": ["bold", "kind"]}`, expected: `{"name": "Ada", "role": "hero", "traits": ["bold", "kind"]}`},
+		{response: `Here is the character: {"name": "Ada"}`, expectedError: "not valid JSON"},
+		{response: `["Ada"]`, expectedError: "$: expected object, got array"},
+		{response: `{"role": "hero"}`, expectedError: `$: missing property "name"`},
+		{response: `{"name": "", "role": "hero"}`, expectedError: "$.name: at least 1 characters expected, got 0"},
+		{response: `{"name": "Ada", "role": "sidekick"}`, expectedError: `$.role: "sidekick" is not one of the allowed values`},
+		{response: `{"name": "Ada", "role": "hero", "age": 36.5}`, expectedError: "$.age: expected integer, got number"},
+		{response: `{"name": "Ada", "role": "hero", "age": -1}`, expectedError: "$.age: -1 is less than the minimum of 0"},
+		{response: `{"name": "Ada", "role": "hero", "traits": ["a", "b", "c", "d"]}`, expectedError: "$.traits: at most 3 items expected, got 4"},
+		{response: `{"name": "Ada", "role": "hero", "traits": ["a", 2]}`, expectedError: "$.traits[1]: expected string, got integer"},
+		{response: `{"name": "Ada", "role": "hero", "pet": "cat"}`, expectedError: `$: unexpected property "pet"`},
+	}
+	for _, tt := range tests {
+		got, err := checkStructured(tt.response, json.RawMessage(characterSchema))
+		if tt.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("%s: expected an error containing %q, got %v", tt.response, tt.expectedError, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.expected {
+			t.Errorf("%s: expected %s, got %s, %v", tt.response, tt.expected, got, err)
+		}
+	}
+}
+
+func TestSchemaGrammar(t *testing.T) {
+	tests := []struct {
+		schema   string
+		expected string
+	}{
+		{schema: `{"type": "string"}`, expected: "root ::= string"},
+		{schema: `{}`, expected: "root ::= value"},
+		{schema: `{"type": ["integer", "null"]}`, expected: "root ::= integer | null"},
+		{schema: `{"enum": ["yes", "no"]}`, expected: `root ::= ( "\"yes\"" | "\"no\"" ) ws`},
+		{schema: `{"type": "array", "items": {"type": "number"}, "minItems": 1}`, expected: `root ::= "[" ws number ( "," ws number )* "]" ws`},
+		{
+			schema: characterSchema,
+			expected: `root-role ::= ( "\"hero\"" | "\"villain\"" ) ws
+root-traits ::= "[" ws ( string ( "," ws string )* )? "]" ws
+root ::= "{" ws "\"age\"" ws ":" ws integer "," ws "\"name\"" ws ":" ws string "," ws "\"role\"" ws ":" ws root-role "," ws "\"traits\"" ws ":" ws root-traits "}" ws`,
+		},
+	}
+	for _, tt := range tests {
+		g, err := schemaGrammar(json.RawMessage(tt.schema))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.schema, err)
+			continue
+		}
+		if !strings.HasPrefix(g, tt.expected+"\n") || !strings.HasSuffix(g, gbnfRules) {
+			t.Errorf("%s: expected grammar\n%s\ngot\n%s", tt.schema, tt.expected, g)
+		}
+	}
+}
+
+func TestCompleteTextSchema(t *testing.T) {
+	response := `{"name": "Ada", "role": "hero"}`
+	f := &fakeCompleter{reply: func(req completionRequest) (completion, error) {
+		return completion{Choices: []string{response}}, nil
+	}}
+	useFakeCompleter(t, f)
+	text := "Describe the hero.\n@SCHEMA\n" + characterSchema + "\n@END\n\nAI: gpt-4o, 100, 0.000, 1"
+	got, _, err := completeText(text, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Describe the hero.\n@SCHEMA\n" + characterSchema + "\n@END\n\n" + response + "\n\nAI: gpt-4o, 100, 0.000, 1"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if req := f.requests[0]; req.Prompt != "Describe the hero.\n\n" || !strings.HasPrefix(string(req.Schema), `{"type":"object"`) {
+		t.Errorf("Expected the schema to be sent apart from the prompt, got %q and %s", req.Prompt, req.Schema)
+	}
+
+	response = `{"name": "Ada"}`
+	_, _, err = completeText(text, "")
+	if err == nil || err.Error() != `gpt-4o: the response does not match the schema: $: missing property "role"` {
+		t.Errorf("Expected a validation error, got %v", err)
+	}
+}
+
+func TestOpenAIPost(t *testing.T) {
+	var body map[string]interface{}
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprint(w, `{"choices": [{"message": {"role": "assistant", "content": "{\"name\": \"Ada\"}"}}], "usage": {"prompt_tokens": 9, "completion_tokens": 5}}`)
+	}))
+	defer server.Close()
+	ep := &endpoint{Name: "local", URL: server.URL + "/v1/chat/completions", Provider: providerOpenAI}
+	maxTokens := 100
+	r := &goopenai.CreateChatCompletionsRequest{Model: "gpt-4o", Messages: []goopenai.Message{{Role: "user", Content: "Describe the hero."}}, MaxTokens: &maxTokens}
+	request, err := openAIRequestFor(r, completionRequest{Schema: json.RawMessage(`{"type":"object"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := openAIPost(context.Background(), ep, "sk-test", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Choices) != 1 || c.Choices[0].Message.Content != `{"name": "Ada"}` || c.Usage.PromptTokens != 9 {
+		t.Errorf("Unexpected response %+v", c)
+	}
+	if auth != "Bearer sk-test" {
+		t.Errorf("Expected the API key to be sent, got %q", auth)
+	}
+	format, _ := json.Marshal(body["response_format"])
+	if string(format) != `{"json_schema":{"name":"document","schema":{"type":"object"}},"type":"json_schema"}` || body["model"] != "gpt-4o" || body["max_tokens"] != float64(100) {
+		t.Errorf("Unexpected request %v", body)
+	}
+}
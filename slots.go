@@ -0,0 +1,100 @@
+package main
+
+// A llama.cpp server keeps the prompt of each of its slots in a KV cache, so a
+// request that goes to the slot that last saw the same document only has to
+// process the text added since. Each document is therefore given a slot of its
+// own, and when there are more documents than slots the one used least
+// recently gives up its slot.
+
+import (
+	"log"
+	"sync"
+)
+
+// slotCount is the number of slots ficta shares out on each llama.cpp
+// server. It should match the server's --parallel (-np) setting.
+var slotCount int
+
+// slotPool assigns the slots of one server to documents.
+type slotPool struct {
+	size   int
+	slots  map[string]int // slot of each document
+	recent []string       // documents, least recently used first
+
+	// Prompt tokens sent and prompt tokens the server found in its cache.
+	promptTokens, cachedTokens int
+}
+
+var (
+	slotPoolsMu sync.Mutex
+	slotPools   = make(map[string]*slotPool) // by endpoint name
+)
+
+// slotFor returns the slot of ep's server to use for the document doc.
+func slotFor(ep *endpoint, doc string) int {
+	slotPoolsMu.Lock()
+	defer slotPoolsMu.Unlock()
+	p, ok := slotPools[ep.Name]
+	if !ok {
+		p = &slotPool{size: max(slotCount, 1), slots: make(map[string]int)}
+		slotPools[ep.Name] = p
+	}
+	return p.assign(doc)
+}
+
+// assign returns doc's slot, giving it a free slot or the slot of the least
+// recently used document if it doesn't have one yet.
+func (p *slotPool) assign(doc string) int {
+	if slot, ok := p.slots[doc]; ok {
+		p.touch(doc)
+		return slot
+	}
+	slot := len(p.slots)
+	if slot >= p.size {
+		evicted := p.recent[0]
+		p.recent = p.recent[1:]
+		slot = p.slots[evicted]
+		delete(p.slots, evicted)
+		log.Printf("llama.cpp slot %d: %s replaces %s", slot, displayName(doc), displayName(evicted))
+	}
+	p.slots[doc] = slot
+	p.recent = append(p.recent, doc)
+	return slot
+}
+
+// touch moves doc to the most recently used end of p.recent.
+func (p *slotPool) touch(doc string) {
+	for i, d := range p.recent {
+		if d == doc {
+			p.recent = append(append(p.recent[:i:i], p.recent[i+1:]...), doc)
+			return
+		}
+	}
+}
+
+// logCacheUse logs how much of a prompt the server of ep took from the cache
+// of the slot, along with the running total for the server. cachedTokens is
+// -1 when the server didn't say.
+func logCacheUse(ep *endpoint, slot, promptTokens, cachedTokens int) {
+	if cachedTokens < 0 {
+		return
+	}
+	slotPoolsMu.Lock()
+	defer slotPoolsMu.Unlock()
+	p, ok := slotPools[ep.Name]
+	if !ok {
+		return
+	}
+	p.promptTokens += promptTokens
+	p.cachedTokens += cachedTokens
+	log.Printf("llama.cpp slot %d: %d of %d prompt tokens cached (%s overall: %d%%)",
+		slot, cachedTokens, promptTokens, ep.Name, 100*p.cachedTokens/max(p.promptTokens, 1))
+}
+
+// displayName names doc in log messages.
+func displayName(doc string) string {
+	if doc == "" {
+		return "an unsaved document"
+	}
+	return doc
+}
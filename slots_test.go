@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestSlotPool(t *testing.T) {
+	p := &slotPool{size: 2, slots: make(map[string]int)}
+	steps := []struct {
+		doc      string
+		expected int
+	}{
+		{"ch1.txt", 0},
+		{"ch2.txt", 1},
+		{"ch1.txt", 0},
+		{"ch3.txt", 1}, // ch2 is the least recently used
+		{"ch1.txt", 0},
+		{"ch2.txt", 1}, // and now ch3 is
+		{"ch2.txt", 1},
+		{"ch3.txt", 0},
+	}
+	for i, s := range steps {
+		if slot := p.assign(s.doc); slot != s.expected {
+			t.Errorf("Step %d: expected %s in slot %d, got %d", i, s.doc, s.expected, slot)
+		}
+	}
+	if len(p.slots) != 2 || len(p.recent) != 2 {
+		t.Errorf("Expected 2 documents in the pool, got %v, %v", p.slots, p.recent)
+	}
+}
+
+func TestSlotFor(t *testing.T) {
+	defer func(n int) { slotCount = n }(slotCount)
+	slotCount = 3
+	a := &endpoint{Name: "slot-test-a"}
+	b := &endpoint{Name: "slot-test-b"}
+	if slotFor(a, "x") != 0 || slotFor(a, "y") != 1 || slotFor(b, "y") != 0 || slotFor(a, "x") != 0 {
+		t.Errorf("Expected each endpoint to have its own pool")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+// "ficta stats" reports how a project is coming along: the size of each
+// document and of the prompt it makes, how much of it the author wrote, and,
+// from the journal, how many completions it took and how many words were
+// added each day.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// documentStats are the statistics of a document, or of a directory of
+// them.
+type documentStats struct {
+	File        string          `json:"file"`
+	Words       int             `json:"words"`
+	AuthorWords int             `json:"author_words"`
+	AIWords     int             `json:"ai_words"`
+	Tokens      int             `json:"tokens"` // estimated, of the prompt
+	Rounds      int             `json:"rounds"` // successful requests
+	Days        []dayStats      `json:"days,omitempty"`
+	Documents   []documentStats `json:"documents,omitempty"` // of a directory
+}
+
+// dayStats is a day's progress on a document.
+type dayStats struct {
+	Date   string `json:"date"`  // YYYY-MM-DD, local time
+	Words  int    `json:"words"` // added, negative if more were cut
+	Rounds int    `json:"rounds"`
+}
+
+// runStats implements the stats subcommand:
+//
+//	ficta stats [-json] file|dir [file|dir ...]
+//
+// A directory's statistics are the sums of those of its documents, which
+// are listed too.
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: ficta stats [-json] file|dir [file|dir ...]")
+	}
+	var all []documentStats
+	for _, arg := range flags.Args() {
+		files, err := exportFiles([]string{arg})
+		if err != nil {
+			return err
+		}
+		var docs []documentStats
+		for _, filename := range files {
+			s, err := statsFor(filename)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			docs = append(docs, s)
+		}
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			all = append(all, sumStats(arg, docs))
+		} else {
+			all = append(all, docs...)
+		}
+	}
+	if *asJSON {
+		out, err := json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	for _, s := range all {
+		printStats(s, "")
+	}
+	return nil
+}
+
+// statsFor returns the statistics of the document filename.
+func statsFor(filename string) (documentStats, error) {
+	s := documentStats{File: filename}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return s, err
+	}
+	text := string(data)
+	clean, _, err := manuscriptText(text, filename)
+	if err != nil {
+		return s, err
+	}
+	s.Words = len(strings.Fields(clean))
+	prompt, _ := findLastAILine(text)
+	if clean, _, err = manuscriptText(prompt, filename); err != nil {
+		return s, err
+	}
+	s.Tokens = estimateTokens(clean)
+	c, err := countProvenance(text, filename)
+	if err != nil {
+		return s, err
+	}
+	s.AuthorWords, s.AIWords = c.HumanWords, c.AIWords
+	entries, err := readJournal(journalPath(filename))
+	if err != nil {
+		return s, err
+	}
+	s.Days = dailyProgress(entries, filepath.Base(filename))
+	for _, d := range s.Days {
+		s.Rounds += d.Rounds
+	}
+	return s, nil
+}
+
+// countWords returns the number of words of the manuscript in text, the
+// contents of the document filename, or 0 if it can't be read.
+func countWords(text, filename string) int {
+	clean, _, err := manuscriptText(text, filename)
+	if err != nil {
+		return 0
+	}
+	return len(strings.Fields(clean))
+}
+
+// readJournal returns the entries of the journal at path, none if it
+// doesn't exist. Lines that aren't entries are skipped.
+func readJournal(path string) ([]journalEntry, error) {
+	if journalName == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e journalEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// dailyProgress returns the progress on the document named file, by day,
+// from its entries in a journal. A day's words are the change in the
+// document's length since the last day that recorded it.
+func dailyProgress(entries []journalEntry, file string) []dayStats {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	var (
+		days []dayStats
+		last int // words at the end of the days before this one
+		end  int // words last recorded
+	)
+	for _, e := range entries {
+		if e.File != file || e.Error != "" {
+			continue
+		}
+		date := e.Time.Local().Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, dayStats{Date: date})
+			last = end
+		}
+		d := &days[len(days)-1]
+		d.Rounds++
+		if e.Words > 0 {
+			end = e.Words
+			d.Words = end - last
+		}
+	}
+	return days
+}
+
+// sumStats returns the statistics of the directory dir made of docs.
+func sumStats(dir string, docs []documentStats) documentStats {
+	s := documentStats{File: dir, Documents: docs}
+	byDate := make(map[string]*dayStats)
+	for _, d := range docs {
+		s.Words += d.Words
+		s.AuthorWords += d.AuthorWords
+		s.AIWords += d.AIWords
+		s.Tokens += d.Tokens
+		s.Rounds += d.Rounds
+		for _, day := range d.Days {
+			if byDate[day.Date] == nil {
+				byDate[day.Date] = &dayStats{Date: day.Date}
+			}
+			byDate[day.Date].Words += day.Words
+			byDate[day.Date].Rounds += day.Rounds
+		}
+	}
+	for _, date := range sortedKeys(byDate) {
+		s.Days = append(s.Days, *byDate[date])
+	}
+	return s
+}
+
+// printStats prints s, and the documents of a directory, each line preceded
+// by indent.
+func printStats(s documentStats, indent string) {
+	fmt.Printf("%s%s: %d words, author %d (%d%%), AI %d (%d%%), ~%d prompt tokens, %d rounds\n",
+		indent, s.File, s.Words, s.AuthorWords, percent(s.AuthorWords, s.AuthorWords+s.AIWords),
+		s.AIWords, percent(s.AIWords, s.AuthorWords+s.AIWords), s.Tokens, s.Rounds)
+	for _, d := range s.Days {
+		fmt.Printf("%s   %s %+6d words %3d rounds\n", indent, d.Date, d.Words, d.Rounds)
+	}
+	for _, doc := range s.Documents {
+		printStats(doc, indent+"   ")
+	}
+}
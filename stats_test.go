@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDailyProgress(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2024, 5, d, h, 0, 0, 0, time.Local) }
+	entries := []journalEntry{
+		{Time: day(2, 9), File: "ch1.ait", Words: 1300},
+		{Time: day(1, 9), File: "ch1.ait", Words: 1000},
+		{Time: day(1, 10), File: "ch1.ait", Words: 1200},
+		{Time: day(1, 11), File: "ch1.ait", Error: "429 Too Many Requests"},
+		{Time: day(1, 12), File: "ch2.ait", Words: 500},
+		{Time: day(2, 10), File: "ch1.ait"},
+		{Time: day(3, 9), File: "ch1.ait"},
+		{Time: day(4, 9), File: "ch1.ait", Words: 1100},
+	}
+	expected := []dayStats{
+		{Date: "2024-05-01", Words: 1200, Rounds: 2},
+		{Date: "2024-05-02", Words: 100, Rounds: 2},
+		{Date: "2024-05-03", Words: 0, Rounds: 1},
+		{Date: "2024-05-04", Words: -200, Rounds: 1},
+	}
+	if got := dailyProgress(entries, "ch1.ait"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	defer func(lc, bp, bs, name string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix, journalName = lc, bp, bs, name
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix, journalName)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	journalName = ".journal.jsonl"
+	dir := t.TempDir()
+	files := map[string]string{
+		"ch1.ait": "Once upon a time // a note\n\n// ficta-ai-begin gpt-4o 2024-05-01T12:30:00Z\nthe fox ran away.\n// ficta-ai-end\n\nAI: gpt-4o, 100, 0.700, 1",
+		"ch2.ait": "The end.\n\nAI: gpt-4o, 100, 0.700, 1",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local)
+	for _, e := range []journalEntry{{Time: at, Words: 8}, {Time: at.Add(time.Hour), Error: "timeout"}} {
+		if err := appendJournal(filepath.Join(dir, "ch1.ait"), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := statsFor(filepath.Join(dir, "ch1.ait"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := documentStats{File: filepath.Join(dir, "ch1.ait"), Words: 8, AuthorWords: 4, AIWords: 4, Tokens: estimateTokens("Once upon a time\n\nthe fox ran away.\n"), Rounds: 1,
+		Days: []dayStats{{Date: "2024-05-01", Words: 8, Rounds: 1}}}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, s)
+	}
+
+	s2, err := statsFor(filepath.Join(dir, "ch2.ait"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := sumStats(dir, []documentStats{s, s2})
+	if total.Words != 10 || total.AuthorWords != 6 || total.Rounds != 1 || len(total.Documents) != 2 || len(total.Days) != 1 {
+		t.Errorf("Unexpected directory statistics %+v", total)
+	}
+	out, err := json.Marshal(total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(out, &decoded); err != nil || decoded["words"] != 10.0 || decoded["author_words"] != 6.0 {
+		t.Errorf("Unexpected JSON %s", out)
+	}
+}
+
+func TestCompleteTextWords(t *testing.T) {
+	useFakeCompleter(t, &fakeCompleter{reply: echoChoices})
+	_, entry, err := completeText("Once upon a time // a note\n\nAI: gpt-4o, 100, 0.700, 1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "Once upon a time" and "It was a dark night."
+	if entry.Words != 9 {
+		t.Errorf("Expected 9 words in the journal entry, got %d", entry.Words)
+	}
+}
+
+func TestCountWords(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	tests := []struct {
+		text     string
+		expected int
+	}{
+		{"Once upon a time.\n\nAI: gpt-4, 100, 0.700, 1", 4},
+		{"Once upon a time.\n\nAI: gpt-4, 100", 4},
+		{"AI: the new frontier.\n\nAI: gpt-4, 100, 0.700, 1", 4},
+	}
+	for _, tt := range tests {
+		if got := countWords(tt.text, "story.ait"); got != tt.expected {
+			t.Errorf("%q: expected %d words, got %d", tt.text, tt.expected, got)
+		}
+	}
+}
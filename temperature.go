@@ -0,0 +1,70 @@
+package main
+
+// The temperature on an AI: line is normalized to 0..1 so that the same line
+// means roughly the same thing whichever model it is sent to. Each provider
+// has a range the normalized value is mapped onto, and an endpoint may
+// declare its own. The raw_temp option bypasses the mapping.
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// rawTempOption is the AI: line option that sets the temperature sent to the
+// server directly, in the server's own units.
+const rawTempOption = "raw_temp"
+
+// temperatureRanges holds the temperature range, lowest and highest, that a
+// normalized temperature of 0 to 1 maps onto for each provider.
+var temperatureRanges = map[string][2]float64{
+	providerOpenAI:    {0, 2},
+	providerGemini:    {0, 2},
+	providerAnthropic: {0, 1},
+	providerOllama:    {0, 1},
+	providerLlamaCpp:  {0, 1},
+}
+
+// llamaCppTemperatureRange is the range for OpenAI compatible endpoints that
+// are llama.cpp servers, whose samplers expect the same values as /completion.
+var llamaCppTemperatureRange = temperatureRanges[providerLlamaCpp]
+
+// temperatureRange returns the range ep's normalized temperatures map onto.
+func (ep *endpoint) temperatureRange() [2]float64 {
+	switch {
+	case ep.TemperatureRange != nil:
+		return *ep.TemperatureRange
+	case ep.Provider == providerOpenAI && ep.LlamaCpp:
+		return llamaCppTemperatureRange
+	}
+	if r, ok := temperatureRanges[ep.Provider]; ok {
+		return r
+	}
+	return temperatureRanges[providerOpenAI]
+}
+
+// temperature returns the temperature to send to ep for req: its raw
+// temperature if one was given, otherwise its normalized temperature mapped
+// onto ep's range.
+func (ep *endpoint) temperature(req completionRequest) float64 {
+	if req.RawTemperature != nil {
+		return *req.RawTemperature
+	}
+	r := ep.temperatureRange()
+	return r[0] + req.Temperature*(r[1]-r[0])
+}
+
+// readRawTemperature moves the raw_temp option from req's options to
+// req.RawTemperature.
+func readRawTemperature(req *completionRequest) error {
+	v, ok := req.Options[rawTempOption]
+	if !ok {
+		return nil
+	}
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil || t < 0 {
+		return fmt.Errorf("option %s=%s: must be a number, 0 or more", rawTempOption, v)
+	}
+	req.RawTemperature = &t
+	delete(req.Options, rawTempOption)
+	return nil
+}
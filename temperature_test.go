@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEndpointTemperature(t *testing.T) {
+	raw := 1.3
+	tests := []struct {
+		name     string
+		ep       *endpoint
+		req      completionRequest
+		expected float64
+	}{
+		{name: "OpenAI", ep: &endpoint{Provider: providerOpenAI}, req: completionRequest{Temperature: 0.7}, expected: 1.4},
+		{name: "Gemini", ep: &endpoint{Provider: providerGemini}, req: completionRequest{Temperature: 0.5}, expected: 1},
+		{name: "Anthropic", ep: &endpoint{Provider: providerAnthropic}, req: completionRequest{Temperature: 0.7}, expected: 0.7},
+		{name: "llama.cpp", ep: &endpoint{Provider: providerLlamaCpp}, req: completionRequest{Temperature: 0.7}, expected: 0.7},
+		{name: "OpenAI compatible llama.cpp", ep: &endpoint{Provider: providerOpenAI, LlamaCpp: true}, req: completionRequest{Temperature: 0.7}, expected: 0.7},
+		{name: "Configured range", ep: &endpoint{Provider: providerOpenAI, TemperatureRange: &[2]float64{0.5, 1.5}}, req: completionRequest{Temperature: 0.25}, expected: 0.75},
+		{name: "Raw", ep: &endpoint{Provider: providerAnthropic}, req: completionRequest{Temperature: 0.2, RawTemperature: &raw}, expected: 1.3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ep.temperature(tt.req); got < tt.expected-1e-9 || got > tt.expected+1e-9 {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestReadRawTemperature(t *testing.T) {
+	req := completionRequest{Options: map[string]string{"raw_temp": "1.25", "seed": "1"}}
+	if err := readRawTemperature(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.RawTemperature == nil || *req.RawTemperature != 1.25 || len(req.Options) != 1 {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	for _, v := range []string{"hot", "-1"} {
+		req = completionRequest{Options: map[string]string{"raw_temp": v}}
+		if err := readRawTemperature(&req); err == nil || !strings.Contains(err.Error(), "raw_temp="+v) {
+			t.Errorf("Expected an error for raw_temp=%s, got %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+// New documents start from a template: one of the built-in ones below, or a
+// file in the templates directory next to the config file, which replaces a
+// built-in template of the same name. "ficta new -t essay draft.ait" picks
+// one; otherwise a directory's .ficta-template file names its default, and
+// "story" is used everywhere else. Templates may use the variables {{date}},
+// {{title}}, {{author}} and {{model}}.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	templateDir    string // user templates, set by loadConfig
+	templateAuthor string // the config file's author
+	templateModel  string // the config file's default_model
+)
+
+// defaultTemplate is the template of new documents in directories without
+// a .ficta-template file.
+const defaultTemplate = "story"
+
+// templateDefaultModel is {{model}} when the config file has no
+// default_model.
+const templateDefaultModel = "gpt-3.5-turbo"
+
+// directoryTemplateName is the file that names the template for new
+// documents in its directory.
+const directoryTemplateName = ".ficta-template"
+
+// builtinTemplates are the templates that exist without configuration.
+// Lines starting with "// " are comments, written in the comment syntax of
+// the new document.
+var builtinTemplates = map[string]string{
+	"story": `// {{title}}, a short story by {{author}}, begun {{date}}.
+// Notes in comments like this one are never sent to the model.
+Continue the story that starts below in the same voice and tense.
+
+# {{title}}
+
+Once upon a time
+
+AI: {{model}}, 300, 0.800, 1`,
+	"essay": `// {{title}}, an essay by {{author}}, begun {{date}}.
+// State your thesis, then write the first paragraph yourself.
+Continue the essay below. Keep its argument and tone and write clear, plain prose.
+
+# {{title}}
+
+Thesis:
+
+AI: {{model}}, 400, 0.500, 1`,
+	"outline": `// {{title}}, an outline by {{author}}, begun {{date}}.
+Continue the outline below for a story titled "{{title}}". Add chapters in the same format: a number, a one-line summary and a bulleted list of scenes.
+
+1.
+
+AI: {{model}}, 300, 0.700, 1`,
+	"dialogue": `// {{title}}, a dialogue by {{author}}, begun {{date}}.
+// Describe the speakers and the situation, then start the conversation.
+Continue the dialogue below. Write only the speakers' lines, each starting with the speaker's name and a colon.
+
+Speakers:
+Situation:
+
+A:
+
+AI: {{model}}, 200, 0.800, 1`,
+	"chat": `// {{title}}, begun {{date}}.
+// Write your messages above the AI: line; each answer is added below them.
+You are a helpful assistant. Answer the last message below.
+
+{{author}}:
+
+AI: {{model}}, 500, 0.700, 1`,
+}
+
+// runNew implements the new subcommand:
+//
+//	ficta new [-t template] file [file ...]
+//	ficta new -l
+//
+// It creates each file from the template and leaves existing files alone.
+func runNew(args []string) error {
+	flags := flag.NewFlagSet("new", flag.ContinueOnError)
+	name := flags.String("t", "", "template, default is the directory's or "+defaultTemplate)
+	list := flags.Bool("l", false, "list the templates")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *list {
+		for _, name := range templateNames() {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: ficta new [-t template] file [file ...]")
+	}
+	for _, filename := range flags.Args() {
+		if _, err := os.Stat(filename); err == nil {
+			return fmt.Errorf("%s already exists", filename)
+		}
+		content, err := newDocument(filename, *name, time.Now())
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(content); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Println("created", filename)
+	}
+	return nil
+}
+
+// newDocument returns the contents of the new document filename made from
+// the template name, or from its directory's default template if name is
+// "".
+func newDocument(filename, name string, now time.Time) (string, error) {
+	if name == "" {
+		name = directoryTemplate(filepath.Dir(filename))
+	}
+	text, builtin, err := templateText(name)
+	if err != nil {
+		return "", err
+	}
+	if builtin {
+		syn, err := commentSyntaxFor(filename, "")
+		if err != nil {
+			return "", err
+		}
+		// In org documents, "# " starts a comment and "* " a heading.
+		org := syn.Line == "#" && syn.LineStart
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			if s, ok := strings.CutPrefix(line, "// "); ok {
+				lines[i] = syn.comment(s)
+			} else if s, ok := strings.CutPrefix(line, "# "); ok && org {
+				lines[i] = "* " + s
+			}
+		}
+		text = strings.Join(lines, "\n")
+	}
+	model := templateModel
+	if model == "" {
+		model = templateDefaultModel
+	}
+	return strings.NewReplacer(
+		"{{date}}", now.Format("2006-01-02"),
+		"{{title}}", documentTitle(filename),
+		"{{author}}", authorName(),
+		"{{model}}", model,
+	).Replace(text), nil
+}
+
+// directoryTemplate returns the name of the default template of the
+// directory dir.
+func directoryTemplate(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, directoryTemplateName))
+	if err != nil || strings.TrimSpace(string(data)) == "" {
+		return defaultTemplate
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// templateText returns the template name and whether it is built in.
+func templateText(name string) (string, bool, error) {
+	if path, ok := userTemplate(name); ok {
+		data, err := os.ReadFile(path)
+		return string(data), false, err
+	}
+	if text, ok := builtinTemplates[name]; ok {
+		return text, true, nil
+	}
+	return "", false, fmt.Errorf("unknown template %q, use %s", name, strings.Join(templateNames(), ", "))
+}
+
+// userTemplate returns the path of the user template name: a file in
+// templateDir called name, with or without an extension.
+func userTemplate(name string) (string, bool) {
+	if templateDir == "" || name == "" || strings.ContainsAny(name, `/\*?[`) {
+		return "", false
+	}
+	matches, _ := filepath.Glob(filepath.Join(templateDir, name+".*"))
+	if info, err := os.Stat(filepath.Join(templateDir, name)); err == nil && !info.IsDir() {
+		matches = append([]string{filepath.Join(templateDir, name)}, matches...)
+	}
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[0], true
+}
+
+// templateNames returns the names of the built-in and user templates.
+func templateNames() []string {
+	names := make(map[string]bool)
+	for name := range builtinTemplates {
+		names[name] = true
+	}
+	if templateDir != "" {
+		entries, _ := os.ReadDir(templateDir)
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				names[strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))] = true
+			}
+		}
+	}
+	return sortedKeys(names)
+}
+
+// documentTitle returns a title made from filename, e.g. "The long night"
+// for "the-long_night.ait".
+func documentTitle(filename string) string {
+	base := filepath.Base(filename)
+	title := strings.Join(strings.FieldsFunc(strings.TrimSuffix(base, filepath.Ext(base)), func(r rune) bool {
+		return r == '-' || r == '_' || unicode.IsSpace(r)
+	}), " ")
+	if title == "" {
+		return title
+	}
+	r, n := utf8.DecodeRuneInString(title)
+	return string(unicode.ToUpper(r)) + title[n:]
+}
+
+// authorName returns the config file's author, or the name of the user.
+func authorName() string {
+	if templateAuthor != "" {
+		return templateAuthor
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "the author"
+	}
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.Username
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDocument(t *testing.T) {
+	defer func(lc, bp, bs string) {
+		lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = lc, bp, bs
+	}(lineCommentPrefix, blockCommentPrefix, blockCommentSuffix)
+	lineCommentPrefix, blockCommentPrefix, blockCommentSuffix = "//", "/*", "*/"
+	config := t.TempDir()
+	templates := filepath.Join(config, "templates")
+	if err := os.Mkdir(templates, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range map[string]string{
+		"poem.ait": "<!-- {{title}} -->\nWrite a poem.\n\nAI: {{model}}, 100, 0.900, 1",
+		"essay":    "My essay, {{date}}\n\nAI: {{model}}, 400, 0.500, 1",
+	} {
+		if err := os.WriteFile(filepath.Join(templates, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(config, "config.json")
+	if err := os.WriteFile(path, []byte(`{"author": "Ann Writer", "default_model": "gpt-4o"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadConfig("", false) })
+	project := t.TempDir()
+	if err := os.WriteFile(filepath.Join(project, directoryTemplateName), []byte("dialogue\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		filename      string
+		template      string
+		expected      string
+		expectedError string
+	}{
+		{
+			filename: "the-long_night.ait",
+			expected: "// The long night, a short story by Ann Writer, begun 2024-05-01.\n// Notes in comments like this one are never sent to the model.\n" +
+				"Continue the story that starts below in the same voice and tense.\n\n# The long night\n\nOnce upon a time\n\nAI: gpt-4o, 300, 0.800, 1",
+		},
+		{
+			filename: "ideas.md",
+			template: "outline",
+			expected: "<!-- Ideas, an outline by Ann Writer, begun 2024-05-01. -->\nContinue the outline below for a story titled \"Ideas\". " +
+				"Add chapters in the same format: a number, a one-line summary and a bulleted list of scenes.\n\n1.\n\nAI: gpt-4o, 300, 0.700, 1",
+		},
+		{
+			filename: "night.org",
+			expected: "# Night, a short story by Ann Writer, begun 2024-05-01.\n# Notes in comments like this one are never sent to the model.\n" +
+				"Continue the story that starts below in the same voice and tense.\n\n* Night\n\nOnce upon a time\n\nAI: gpt-4o, 300, 0.800, 1",
+		},
+		{
+			filename: "ode.md",
+			template: "poem",
+			expected: "<!-- Ode -->\nWrite a poem.\n\nAI: gpt-4o, 100, 0.900, 1",
+		},
+		{
+			filename: "draft.ait",
+			template: "essay",
+			expected: "My essay, 2024-05-01\n\nAI: gpt-4o, 400, 0.500, 1",
+		},
+		{
+			filename: filepath.Join(project, "scene.ait"),
+			expected: "// Scene, a dialogue by Ann Writer, begun 2024-05-01.\n// Describe the speakers and the situation, then start the conversation.\n" +
+				"Continue the dialogue below. Write only the speakers' lines, each starting with the speaker's name and a colon.\n\n" +
+				"Speakers:\nSituation:\n\nA:\n\nAI: gpt-4o, 200, 0.800, 1",
+		},
+		{
+			filename:      "draft.ait",
+			template:      "sonnet",
+			expectedError: `unknown template "sonnet", use chat, dialogue, essay, outline, poem, story`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := newDocument(tt.filename, tt.template, now)
+		if tt.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("%s: expected an error containing %q, got %v", tt.template, tt.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.filename, tt.template, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s %s: expected %q, got %q", tt.filename, tt.template, tt.expected, got)
+		}
+	}
+}
+
+func TestRunNew(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "chat.ait")
+	if err := runNew([]string{"-t", "chat", filename}); err != nil {
+		t.Fatal(err)
+	}
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aiLine := findLastAILine(string(text))
+	if _, _, _, _, err := parseAILine(aiLine); err != nil {
+		t.Errorf("Expected a document with a valid AI: line, got %q: %v", text, err)
+	}
+	if err := runNew([]string{filename}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected an error for an existing file, got %v", err)
+	}
+}
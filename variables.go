@@ -0,0 +1,91 @@
+package main
+
+// Variables let a document reuse a prompt that differs only by a few values.
+// A line
+//
+//	@SET hero = Willy the weasel
+//
+// defines hero, and {{hero}} anywhere in the prompt is replaced with its
+// value after author comments are removed. A value may use the variables
+// defined above it. \{{hero}} is sent as {{hero}}. A variable that isn't
+// defined stops the request, and the error is noted in the document.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// setDirective starts a variable definition line.
+const setDirective = "@SET"
+
+var (
+	variableName      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	variableReference = regexp.MustCompile(`(\\?)\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// extractVariables removes the @SET lines from prompt and returns what
+// remains along with the variables they define, added to defaults. A later
+// definition of a variable replaces an earlier one.
+func extractVariables(prompt string, defaults map[string]string) (string, map[string]string, error) {
+	var kept []string
+	vars := make(map[string]string)
+	for name, value := range defaults {
+		vars[name] = value
+	}
+	for _, line := range strings.Split(prompt, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != setDirective && !strings.HasPrefix(trimmed, setDirective+" ") && !strings.HasPrefix(trimmed, setDirective+"\t") {
+			kept = append(kept, line)
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(trimmed, setDirective), "=")
+		name = strings.TrimSpace(name)
+		if !ok || !variableName.MatchString(name) {
+			return prompt, nil, fmt.Errorf("%s: expected name = value, got %q", setDirective, trimmed)
+		}
+		value, err := expandVariables(strings.TrimSpace(value), vars)
+		if err != nil {
+			return prompt, nil, fmt.Errorf("%s %s: %w", setDirective, name, err)
+		}
+		vars[name] = value
+	}
+	return strings.Join(kept, "\n"), vars, nil
+}
+
+// expandVariables replaces the variable references in text with the values
+// of vars and reports the variables that are not defined.
+func expandVariables(text string, vars map[string]string) (string, error) {
+	var undefined []string
+	expanded := variableReference.ReplaceAllStringFunc(text, func(ref string) string {
+		m := variableReference.FindStringSubmatch(ref)
+		if m[1] != "" {
+			return ref[1:]
+		}
+		value, ok := vars[m[2]]
+		if !ok {
+			if !contains(undefined, m[2]) {
+				undefined = append(undefined, m[2])
+			}
+			return ref
+		}
+		return value
+	})
+	switch len(undefined) {
+	case 0:
+		return expanded, nil
+	case 1:
+		return text, fmt.Errorf("undefined variable %s", undefined[0])
+	}
+	return text, fmt.Errorf("undefined variables %s", strings.Join(undefined, ", "))
+}
+
+// substituteVariables removes the variable definitions from prompt and
+// replaces the references to them and to the variables of defaults.
+func substituteVariables(prompt string, defaults map[string]string) (string, error) {
+	prompt, vars, err := extractVariables(prompt, defaults)
+	if err != nil {
+		return prompt, err
+	}
+	return expandVariables(prompt, vars)
+}
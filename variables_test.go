@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubstituteVariables(t *testing.T) {
+	tests := []struct {
+		name          string
+		prompt        string
+		expected      string
+		expectedError string
+	}{
+		{name: "No variables", prompt: "Once upon a time", expected: "Once upon a time"},
+		{name: "Variable", prompt: "@SET hero = Willy\nOnce upon a time {{hero}} ran.", expected: "Once upon a time Willy ran."},
+		{name: "Spaces in references", prompt: "@SET hero=Willy\n{{ hero }} and {{hero}}", expected: "Willy and Willy"},
+		{name: "Indented definition", prompt: "  @SET tone = grim  \nA {{tone}} tale", expected: "A grim tale"},
+		{name: "Definition after use", prompt: "{{town}} slept.\n@SET town = Ashby", expected: "Ashby slept."},
+		{name: "Redefinition", prompt: "@SET x = 1\n@SET x = 2\n{{x}}", expected: "2"},
+		{name: "Value using a variable", prompt: "@SET hero = Willy\n@SET title = The Tale of {{hero}}\n{{title}}", expected: "The Tale of Willy"},
+		{name: "Empty value", prompt: "@SET aside =\nA{{aside}}B", expected: "AB"},
+		{name: "Escaped reference", prompt: `@SET hero = Willy` + "\n" + `Write \{{hero}} for {{hero}}.`, expected: "Write {{hero}} for Willy."},
+		{name: "Not a reference", prompt: "A {{ }} and {{two words}}", expected: "A {{ }} and {{two words}}"},
+		{name: "Not a definition", prompt: "@SETTING sun", expected: "@SETTING sun"},
+		{name: "Undefined variable", prompt: "{{hero}} met {{villain}} and {{hero}} ran.\n@SET hero = Willy", expectedError: "undefined variable villain"},
+		{name: "Undefined variables", prompt: "{{hero}} met {{villain}}", expectedError: "undefined variables hero, villain"},
+		{name: "Undefined in a value", prompt: "@SET title = The Tale of {{hero}}", expectedError: "@SET title: undefined variable hero"},
+		{name: "Missing value", prompt: "@SET hero Willy", expectedError: `@SET: expected name = value, got "@SET hero Willy"`},
+		{name: "Bad name", prompt: "@SET the hero = Willy", expectedError: "expected name = value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := substituteVariables(tt.prompt, nil)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("Expected an error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil || got != tt.expected {
+				t.Errorf("Expected %q, got %q, %v", tt.expected, got, err)
+			}
+		})
+	}
+}
+
+func TestCompleteTextVariables(t *testing.T) {
+	f := &fakeCompleter{reply: echoChoices}
+	useFakeCompleter(t, f)
+	text := "@SET hero = Willy\n// @SET hero = Worgus\nOnce upon a time {{hero}} ran.\n\nAI: gpt-4, 100, 0.500, 1"
+	got, _, err := completeText(text, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "@SET hero = Willy\n// @SET hero = Worgus\nOnce upon a time {{hero}} ran.\n\nIt was a dark night.") {
+		t.Errorf("Expected the document to keep its variables, got %q", got)
+	}
+	if prompt := f.requests[0].Prompt; prompt != "Once upon a time Willy ran.\n\n" {
+		t.Errorf("Expected the variables to be substituted, got %q", prompt)
+	}
+
+	_, _, err = completeText("Once upon a time {{hero}} ran.\n\nAI: gpt-4, 100, 0.500, 1", "")
+	if err == nil || err.Error() != "undefined variable hero" || f.count() != 1 {
+		t.Errorf("Expected an undefined variable error without a request, got %v", err)
+	}
+}